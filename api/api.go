@@ -0,0 +1,164 @@
+// Package api implements the JSON API served under /api/v1. It
+// uses the same services as the HTML controllers.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/policy"
+)
+
+// maxBodyBytes is the largest JSON request body we accept.
+const maxBodyBytes = 1 << 20
+
+const (
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeUnverified   = "unverified"
+	CodeNotFound     = "not_found"
+	CodeTooLarge     = "too_large"
+	CodeRateLimited  = "rate_limited"
+	CodeInvalid      = "invalid"
+	CodeInternal     = "internal"
+)
+
+var (
+	errUnauthorized = apiError{http.StatusUnauthorized, CodeUnauthorized, "You must be logged in to do this"}
+	errRateLimited  = apiError{http.StatusTooManyRequests, CodeRateLimited, "Too many requests. Please slow down."}
+	errBadJSON      = apiError{http.StatusBadRequest, CodeBadRequest, "Request body must be a valid JSON object"}
+	errInternal     = apiError{http.StatusInternalServerError, CodeInternal, "Something went wrong. Please try again, and contact us if the problem persists."}
+)
+
+// ErrorBody is the envelope every error response is sent in, eg:
+//
+//	{"error": {"code": "not_found", "message": "Resource not found"}}
+type ErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e apiError) Error() string {
+	return e.Message
+}
+
+// publicError is implemented by the models errors that are safe to
+// show to users.
+type publicError interface {
+	error
+	Public() string
+}
+
+// toAPIError will turn err into the error we respond with. Errors
+// that are not meant for users are logged and replaced with a
+// generic message.
+func toAPIError(err error) apiError {
+	var aErr apiError
+	if errors.As(err, &aErr) {
+		return aErr
+	}
+	switch err {
+	case models.ErrNotFound, policy.ErrNotFound:
+		return apiError{http.StatusNotFound, CodeNotFound, "Resource not found"}
+	case policy.ErrForbidden:
+		return apiError{http.StatusForbidden, CodeForbidden, "You do not have permission to do this"}
+	case policy.ErrUnverified:
+		return apiError{http.StatusForbidden, CodeUnverified, "You must verify your email address to do this"}
+	case models.ErrImageTooLarge, models.ErrImageUploadTooLarge:
+		return apiError{http.StatusRequestEntityTooLarge, CodeTooLarge, err.(publicError).Public()}
+	}
+	if pErr, ok := err.(publicError); ok {
+		return apiError{http.StatusUnprocessableEntity, CodeInvalid, pErr.Public()}
+	}
+	log.Println(err)
+	return errInternal
+}
+
+// writeJSON will write v as the JSON response body. The CSRF token
+// is sent in the X-CSRF-Token header so that clients authenticated
+// with cookies can send it back with unsafe requests.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if token := csrf.Token(r); token != "" {
+		w.Header().Set("X-CSRF-Token", token)
+	}
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	aErr := toAPIError(err)
+	writeJSON(w, r, aErr.Status, ErrorBody{Error: aErr})
+}
+
+// decodeJSON will decode the JSON request body into dst.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		if err == io.EOF {
+			return errBadJSON
+		}
+		return apiError{http.StatusBadRequest, CodeBadRequest, "Invalid request body: " + err.Error()}
+	}
+	return nil
+}
+
+// RateLimited writes the error for requests over the rate limit.
+// It is meant for the Denied field of middleware.RateLimit.
+func RateLimited(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, errRateLimited)
+}
+
+// RequireUser is like middleware.RequireUser, but responds with a
+// 401 error instead of redirecting to the login page.
+func RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) == nil {
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// gallery will look up the gallery with the id found in the URL,
+// making sure the current user may perform the action on it. If
+// it fails the error is written and ok is false.
+func gallery(w http.ResponseWriter, r *http.Request, p *policy.Policy, action policy.Action) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, models.ErrNotFound)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	g, err := p.Gallery(user, uint(id), action)
+	if err == nil && !safeMethod(r.Method) {
+		err = p.Verified(user, action)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	return g, true
+}
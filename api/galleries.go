@@ -0,0 +1,213 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/policy"
+)
+
+// Gallery is the JSON representation of a gallery. ShareURL is
+// only set for users who manage sharing.
+type Gallery struct {
+	ID         uint      `json:"id"`
+	UserID     uint      `json:"user_id"`
+	Title      string    `json:"title"`
+	Visibility string    `json:"visibility"`
+	Role       string    `json:"role,omitempty"`
+	ShareURL   string    `json:"share_url,omitempty"`
+	Images     []Image   `json:"images,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func newGallery(g *models.Gallery) Gallery {
+	ret := Gallery{
+		ID:         g.ID,
+		UserID:     g.UserID,
+		Title:      g.Title,
+		Visibility: g.Visibility,
+		Role:       g.Role,
+		CreatedAt:  g.CreatedAt,
+		UpdatedAt:  g.UpdatedAt,
+	}
+	if g.IsShared() && g.CanManageMembers() {
+		ret.ShareURL = g.SharePath()
+	}
+	for i := range g.Images {
+		ret.Images = append(ret.Images, newImage(&g.Images[i]))
+	}
+	return ret
+}
+
+// GalleryList is the response of the galleries index.
+type GalleryList struct {
+	Owned  []Gallery `json:"owned"`
+	Shared []Gallery `json:"shared"`
+}
+
+// GalleryRequest is the body used to create and update galleries.
+// Fields left out are not changed by updates.
+type GalleryRequest struct {
+	Title      *string `json:"title"`
+	Visibility *string `json:"visibility"`
+}
+
+func NewGalleries(gs models.GalleryService, is models.ImageService, ms models.MemberService, p *policy.Policy) *Galleries {
+	return &Galleries{
+		gs:     gs,
+		is:     is,
+		ms:     ms,
+		policy: p,
+	}
+}
+
+type Galleries struct {
+	gs     models.GalleryService
+	is     models.ImageService
+	ms     models.MemberService
+	policy *policy.Policy
+}
+
+// Index lists the galleries the current user owns and the ones
+// shared with them.
+//
+// GET /api/v1/galleries
+func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	owned, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	members, err := g.ms.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	roles := make(map[uint]string, len(members))
+	ids := make([]uint, len(members))
+	for i, m := range members {
+		roles[m.GalleryID] = m.Role
+		ids[i] = m.GalleryID
+	}
+	shared, err := g.gs.ByIDs(ids)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ret := GalleryList{
+		Owned:  make([]Gallery, 0, len(owned)),
+		Shared: make([]Gallery, 0, len(shared)),
+	}
+	for i := range owned {
+		owned[i].Role = models.RoleOwner
+		ret.Owned = append(ret.Owned, newGallery(&owned[i]))
+	}
+	for i := range shared {
+		shared[i].Role = roles[shared[i].ID]
+		ret.Shared = append(ret.Shared, newGallery(&shared[i]))
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+// Create creates a gallery owned by the current user.
+//
+// POST /api/v1/galleries
+func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
+	var req GalleryRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user := context.User(r.Context())
+	gallery := models.Gallery{
+		UserID: user.ID,
+		Role:   models.RoleOwner,
+	}
+	if req.Title != nil {
+		gallery.Title = *req.Title
+	}
+	if req.Visibility != nil {
+		gallery.Visibility = *req.Visibility
+	}
+	if err := g.gs.Create(&gallery); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, newGallery(&gallery))
+}
+
+// Show returns a gallery along with its images. Public galleries
+// can be seen without logging in.
+//
+// GET /api/v1/galleries/:id
+func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := gallery(w, r, g.policy, policy.ActionView)
+	if !ok {
+		return
+	}
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	gallery.Images = images
+	writeJSON(w, r, http.StatusOK, newGallery(gallery))
+}
+
+// Update changes the title and the visibility of a gallery.
+//
+// PATCH /api/v1/galleries/:id
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	var req GalleryRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	action := policy.ActionEdit
+	if req.Title == nil && req.Visibility != nil {
+		action = policy.ActionShare
+	}
+	gallery, ok := gallery(w, r, g.policy, action)
+	if !ok {
+		return
+	}
+	if req.Title != nil {
+		gallery.Title = *req.Title
+	}
+	if req.Visibility != nil && *req.Visibility != gallery.Visibility {
+		user := context.User(r.Context())
+		_, err := g.policy.Gallery(user, gallery.ID, policy.ActionShare)
+		if err == nil {
+			err = g.policy.Verified(user, policy.ActionShare)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		gallery.Visibility = *req.Visibility
+	}
+	if err := g.gs.Update(gallery); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newGallery(gallery))
+}
+
+// Delete deletes a gallery.
+//
+// DELETE /api/v1/galleries/:id
+func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := gallery(w, r, g.policy, policy.ActionDelete)
+	if !ok {
+		return
+	}
+	if err := g.gs.Delete(gallery.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusNoContent, nil)
+}
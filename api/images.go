@@ -0,0 +1,171 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/policy"
+)
+
+// maxMultipartMem = 1MB
+const maxMultipartMem = 1 << 20
+
+// Image is the JSON representation of an image. Variants maps the
+// size of every resized variant to its URL.
+type Image struct {
+	ID               uint              `json:"id"`
+	GalleryID        uint              `json:"gallery_id"`
+	Filename         string            `json:"filename"`
+	OriginalFilename string            `json:"original_filename"`
+	ContentType      string            `json:"content_type"`
+	Size             int64             `json:"size"`
+	Width            int               `json:"width"`
+	Height           int               `json:"height"`
+	Caption          string            `json:"caption"`
+	Position         int               `json:"position"`
+	URL              string            `json:"url"`
+	Variants         map[string]string `json:"variants"`
+	CapturedAt       *time.Time        `json:"captured_at,omitempty"`
+	Camera           string            `json:"camera,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+}
+
+func newImage(i *models.Image) Image {
+	return Image{
+		ID:               i.ID,
+		GalleryID:        i.GalleryID,
+		Filename:         i.Filename,
+		OriginalFilename: i.OriginalFilename,
+		ContentType:      i.ContentType,
+		Size:             i.Size,
+		Width:            i.Width,
+		Height:           i.Height,
+		Caption:          i.Caption,
+		Position:         i.Position,
+		URL:              i.Path(),
+		Variants: map[string]string{
+			models.ImageThumb:  i.VariantPath(models.ImageThumb),
+			models.ImageMedium: i.VariantPath(models.ImageMedium),
+			models.ImageLarge:  i.VariantPath(models.ImageLarge),
+		},
+		CapturedAt: i.CapturedAt,
+		Camera:     i.Camera(),
+		CreatedAt:  i.CreatedAt,
+	}
+}
+
+func NewImages(is models.ImageService, p *policy.Policy) *Images {
+	return &Images{
+		is:     is,
+		policy: p,
+	}
+}
+
+type Images struct {
+	is     models.ImageService
+	policy *policy.Policy
+}
+
+// Index lists the images of a gallery.
+//
+// GET /api/v1/galleries/:id/images
+func (i *Images) Index(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := gallery(w, r, i.policy, policy.ActionView)
+	if !ok {
+		return
+	}
+	images, err := i.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ret := make([]Image, 0, len(images))
+	for j := range images {
+		ret = append(ret, newImage(&images[j]))
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+// Create uploads the images sent in the "images" field of a
+// multipart form, and returns them.
+//
+// POST /api/v1/galleries/:id/images
+func (i *Images) Create(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := gallery(w, r, i.policy, policy.ActionUpload)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	// Leave some room for the multipart boundaries and other fields.
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxImageUploadBytes+maxMultipartMem)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeError(w, r, models.ErrImageUploadTooLarge)
+			return
+		}
+		writeError(w, r, apiError{http.StatusBadRequest, CodeBadRequest, "Request body must be a multipart form"})
+		return
+	}
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		writeError(w, r, models.ErrImageEmpty)
+		return
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	if total > models.MaxImageUploadBytes {
+		writeError(w, r, models.ErrImageUploadTooLarge)
+		return
+	}
+
+	ret := make([]Image, 0, len(files))
+	for _, f := range files {
+		file, err := f.Open()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		image := models.Image{
+			GalleryID:    gallery.ID,
+			UserID:       user.ID,
+			Filename:     f.Filename,
+			KeepMetadata: user.KeepImageMetadata,
+		}
+		if err := i.is.Create(&image, file); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		ret = append(ret, newImage(&image))
+	}
+	writeJSON(w, r, http.StatusCreated, ret)
+}
+
+// Delete deletes an image.
+//
+// DELETE /api/v1/galleries/:id/images/:filename
+func (i *Images) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := gallery(w, r, i.policy, policy.ActionDeleteImages)
+	if !ok {
+		return
+	}
+	image, err := i.is.ByFilename(gallery.ID, mux.Vars(r)["filename"])
+	if err == models.ErrFilenameInvalid {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := i.is.Delete(image); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusNoContent, nil)
+}
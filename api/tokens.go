@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/csrf"
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+)
+
+var (
+	errAuthHeaderInvalid = apiError{http.StatusUnauthorized, CodeUnauthorized, `Authorization header must be "Bearer <token>"`}
+	errTokenInvalid      = apiError{http.StatusUnauthorized, CodeUnauthorized, "API token is not valid or has been revoked"}
+	errTokenReadOnly     = apiError{http.StatusForbidden, CodeForbidden, "API token is read-only"}
+)
+
+// TokenAuth authenticates the API requests that carry an
+// "Authorization: Bearer <token>" header with the personal API
+// token of a user. Such requests are exempt from CSRF checks, since
+// browsers never add the header on their own, so it has to wrap
+// the csrf.Protect middleware. Requests outside of the API are left
+// untouched.
+type TokenAuth struct {
+	models.APITokenService
+}
+
+func (mw *TokenAuth) Apply(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if auth == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		const prefix = "Bearer "
+		if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+			writeError(w, r, errAuthHeaderInvalid)
+			return
+		}
+		user, token, err := mw.Authenticate(strings.TrimSpace(auth[len(prefix):]))
+		if err == models.ErrNotFound {
+			err = errTokenInvalid
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !token.CanWrite() && !safeMethod(r.Method) {
+			writeError(w, r, errTokenReadOnly)
+			return
+		}
+		ctx := r.Context()
+		ctx = context.WithUser(ctx, user)
+		ctx = context.WithAPIToken(ctx, token)
+		r = csrf.UnsafeSkipCheck(r.WithContext(ctx))
+		next.ServeHTTP(w, r)
+	}
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+)
+
+// User is the JSON representation of a user.
+type User struct {
+	ID                uint      `json:"id"`
+	Name              string    `json:"name"`
+	Email             string    `json:"email"`
+	KeepImageMetadata bool      `json:"keep_image_metadata"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+func newUser(u *models.User) User {
+	return User{
+		ID:                u.ID,
+		Name:              u.Name,
+		Email:             u.Email,
+		KeepImageMetadata: u.KeepImageMetadata,
+		CreatedAt:         u.CreatedAt,
+	}
+}
+
+func NewUsers() *Users {
+	return &Users{}
+}
+
+type Users struct{}
+
+// Me returns the current user.
+//
+// GET /api/v1/me
+func (u *Users) Me(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	writeJSON(w, r, http.StatusOK, newUser(user))
+}
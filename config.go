@@ -3,24 +3,46 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/oidc"
+	"github.com/monkjunior/goweb.learn/password"
+	"github.com/monkjunior/goweb.learn/policy"
+	"github.com/monkjunior/goweb.learn/ratelimit"
+	"github.com/monkjunior/goweb.learn/storage"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Config struct {
-	Port     int            `json:"port"`
-	Env      string         `json:"env"`
-	Pepper   string         `json:"pepper"`
-	HMACKey  string         `json:"hmac_key"`
-	Database PostgresConfig `json:"database"`
-	Mailgun  MailgunConfig  `json:"mailgun"`
+	Port         int                `json:"port"`
+	Env          string             `json:"env"`
+	Pepper       string             `json:"pepper"`
+	HMACKey      string             `json:"hmac_key"`
+	Database     PostgresConfig     `json:"database"`
+	Mailgun      MailgunConfig      `json:"mailgun"`
+	Storage      StorageConfig      `json:"storage"`
+	Sessions     SessionConfig      `json:"sessions"`
+	Verification VerificationConfig `json:"verification"`
+	RateLimits   RateLimitConfig    `json:"rate_limits"`
+	Passwords    PasswordConfig     `json:"passwords"`
+	OIDC         []OIDCConfig       `json:"oidc"`
+	Trash        TrashConfig        `json:"trash"`
 }
 
 func DefaultConfig() Config {
 	return Config{
-		Port:     8080,
-		Env:      "dev",
-		Pepper:   "ted-is-so-handsome",
-		HMACKey:  "secret-hmac-key",
-		Database: DefaultPostgresConfig(),
+		Port:         8080,
+		Env:          "dev",
+		Pepper:       "ted-is-so-handsome",
+		HMACKey:      "secret-hmac-key",
+		Database:     DefaultPostgresConfig(),
+		Storage:      DefaultStorageConfig(),
+		Sessions:     DefaultSessionConfig(),
+		Verification: DefaultVerificationConfig(),
+		RateLimits:   DefaultRateLimitConfig(),
+		Passwords:    DefaultPasswordConfig(),
+		Trash:        DefaultTrashConfig(),
 	}
 }
 
@@ -61,8 +83,313 @@ func DefaultPostgresConfig() PostgresConfig {
 	}
 }
 
+// SessionConfig sets how long users stay logged in, in hours.
+// LifetimeHours is how long a session lasts after login no matter
+// what, and IdleHours how long it lasts without being used.
+type SessionConfig struct {
+	LifetimeHours int `json:"lifetime_hours"`
+	IdleHours     int `json:"idle_hours"`
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		LifetimeHours: 720,
+		IdleHours:     72,
+	}
+}
+
+// Lifetime converts the config for models.WithSession. Fields that
+// are not set fall back to models.DefaultSessionLifetime.
+func (c SessionConfig) Lifetime() models.SessionLifetime {
+	return models.SessionLifetime{
+		Absolute: time.Duration(c.LifetimeHours) * time.Hour,
+		Idle:     time.Duration(c.IdleHours) * time.Hour,
+	}
+}
+
+// TrashConfig sets how many days deleted galleries and images can
+// be restored before they are purged.
+type TrashConfig struct {
+	RetentionDays int `json:"retention_days"`
+}
+
+func DefaultTrashConfig() TrashConfig {
+	return TrashConfig{
+		RetentionDays: 30,
+	}
+}
+
+// Retention converts the config for models.WithTrash. It falls back
+// to the default when RetentionDays is not set.
+func (c TrashConfig) Retention() time.Duration {
+	days := c.RetentionDays
+	if days <= 0 {
+		days = DefaultTrashConfig().RetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// VerificationConfig lists the policy actions, eg: "upload",
+// "share" or "delete_images", that users may not perform until they
+// verified their email address.
+type VerificationConfig struct {
+	Restrict []string `json:"restrict"`
+}
+
+func DefaultVerificationConfig() VerificationConfig {
+	return VerificationConfig{
+		Restrict: []string{string(policy.ActionUpload)},
+	}
+}
+
+// Restricted converts the config for policy.New.
+func (c VerificationConfig) Restricted() []policy.Action {
+	actions := make([]policy.Action, len(c.Restrict))
+	for i, a := range c.Restrict {
+		actions[i] = policy.Action(a)
+	}
+	return actions
+}
+
+// RateLimitConfig sets the rate limit of each group of routes.
+// Static applies to /assets/ and /images/, and Default to every
+// other request. API applies to /api/v1 and Upload to image
+// uploads, on top of Default. Pages load many images and assets at
+// once, so Static must be much larger than Default. A group with a
+// zero limit is not rate limited.
+type RateLimitConfig struct {
+	Default ratelimit.Limit `json:"default"`
+	Static  ratelimit.Limit `json:"static"`
+	API     ratelimit.Limit `json:"api"`
+	Upload  ratelimit.Limit `json:"upload"`
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Default: ratelimit.Limit{PerMinute: 300, Burst: 100},
+		Static:  ratelimit.Limit{PerMinute: 6000, Burst: 2000},
+		API:     ratelimit.Limit{PerMinute: 120, Burst: 60},
+		Upload:  ratelimit.Limit{PerMinute: 10, Burst: 10},
+	}
+}
+
+// PasswordConfig is the policy passwords must follow. Lengths are
+// in characters and MinStrength goes from 0, any password, to 4,
+// very hard to guess. BreachedDir is a directory of range files of
+// breached password hashes, see password.BreachedList. Leave it
+// empty to skip that check.
+type PasswordConfig struct {
+	MinLength   int                `json:"min_length"`
+	MaxLength   int                `json:"max_length"`
+	MinStrength int                `json:"min_strength"`
+	BreachedDir string             `json:"breached_dir"`
+	Hashing     PasswordHashConfig `json:"hashing"`
+}
+
+func DefaultPasswordConfig() PasswordConfig {
+	return PasswordConfig{
+		MinLength:   8,
+		MaxLength:   64,
+		MinStrength: 2,
+		Hashing:     DefaultPasswordHashConfig(),
+	}
+}
+
+// PasswordHashConfig sets how passwords are hashed. Algorithm is
+// "bcrypt" or "argon2id". Peppers are extra peppers by ID, the
+// pepper of Config having the empty ID, and PepperID is the one new
+// hashes are made with. Hashes made with other settings are
+// replaced when their users log in, so a pepper can only be removed
+// once every user logged in since it stopped being used.
+type PasswordHashConfig struct {
+	Algorithm  string            `json:"algorithm"`
+	BcryptCost int               `json:"bcrypt_cost"`
+	Argon2     Argon2Config      `json:"argon2"`
+	PepperID   string            `json:"pepper_id"`
+	Peppers    map[string]string `json:"peppers"`
+}
+
+// Argon2Config are the cost parameters of argon2id.
+type Argon2Config struct {
+	Time      uint32 `json:"time"`
+	MemoryKiB uint32 `json:"memory_kib"`
+	Threads   uint8  `json:"threads"`
+}
+
+func DefaultPasswordHashConfig() PasswordHashConfig {
+	return PasswordHashConfig{
+		Algorithm:  password.Bcrypt,
+		BcryptCost: bcrypt.DefaultCost,
+		Argon2: Argon2Config{
+			Time:      1,
+			MemoryKiB: 64 * 1024,
+			Threads:   4,
+		},
+	}
+}
+
+// Hasher converts the config for models.WithUser, pepper being the
+// one with the empty ID. Fields that are not set fall back to the
+// defaults.
+func (c PasswordHashConfig) Hasher(pepper string) (*password.Hasher, error) {
+	def := DefaultPasswordHashConfig()
+	h := password.Hasher{
+		Algorithm:  c.Algorithm,
+		BcryptCost: c.BcryptCost,
+		Argon2: password.Argon2Params{
+			Time:    c.Argon2.Time,
+			Memory:  c.Argon2.MemoryKiB,
+			Threads: c.Argon2.Threads,
+		},
+		Peppers:  map[string]string{"": pepper},
+		PepperID: c.PepperID,
+	}
+	if h.Algorithm == "" {
+		h.Algorithm = def.Algorithm
+	}
+	if h.BcryptCost == 0 {
+		h.BcryptCost = def.BcryptCost
+	}
+	if h.Argon2.Time == 0 {
+		h.Argon2.Time = def.Argon2.Time
+	}
+	if h.Argon2.Memory == 0 {
+		h.Argon2.Memory = def.Argon2.MemoryKiB
+	}
+	if h.Argon2.Threads == 0 {
+		h.Argon2.Threads = def.Argon2.Threads
+	}
+	for id, p := range c.Peppers {
+		if id == "" || strings.Contains(id, "$") {
+			return nil, fmt.Errorf("config: invalid pepper ID %q", id)
+		}
+		h.Peppers[id] = p
+	}
+	if _, ok := h.Peppers[h.PepperID]; !ok {
+		return nil, fmt.Errorf("config: no pepper with ID %q", h.PepperID)
+	}
+	switch h.Algorithm {
+	case password.Bcrypt, password.Argon2id:
+	default:
+		return nil, fmt.Errorf("config: unknown password hashing algorithm %q", h.Algorithm)
+	}
+	return &h, nil
+}
+
+// Policy converts the config for models.WithUser. Lengths that are
+// not set fall back to the defaults.
+func (c PasswordConfig) Policy() *password.Policy {
+	def := DefaultPasswordConfig()
+	p := password.Policy{
+		MinLength:   c.MinLength,
+		MaxLength:   c.MaxLength,
+		MinStrength: c.MinStrength,
+	}
+	if p.MinLength == 0 {
+		p.MinLength = def.MinLength
+	}
+	if p.MaxLength == 0 {
+		p.MaxLength = def.MaxLength
+	}
+	if c.BreachedDir != "" {
+		p.Breached = &password.BreachedList{Dir: c.BreachedDir}
+	}
+	return &p
+}
+
+// OIDCConfig describes an OpenID Connect identity provider users can
+// log in with. Name is used in URLs and must not change once users
+// linked accounts, and the redirect URL is
+// <our URL>/auth/<name>/callback.
+type OIDCConfig struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// Providers converts the configs for the controllers.
+func Providers(configs []OIDCConfig) ([]*oidc.Provider, error) {
+	providers := make([]*oidc.Provider, 0, len(configs))
+	seen := make(map[string]bool)
+	for _, c := range configs {
+		if c.Name == "" || c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+			return nil, fmt.Errorf("oidc provider %q: name, issuer, client_id and redirect_url are required", c.Name)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("oidc provider %q is configured twice", c.Name)
+		}
+		seen[c.Name] = true
+		if c.DisplayName == "" {
+			c.DisplayName = c.Name
+		}
+		providers = append(providers, oidc.New(oidc.Config{
+			Name:         c.Name,
+			DisplayName:  c.DisplayName,
+			Issuer:       c.Issuer,
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			RedirectURL:  c.RedirectURL,
+			Scopes:       c.Scopes,
+		}))
+	}
+	return providers, nil
+}
+
 type MailgunConfig struct {
 	ApiKey       string `json:"api_key"`
 	PublicApiKey string `json:"public_api_key"`
 	Domain       string `json:"domain"`
 }
+
+// StorageConfig selects where uploaded images are stored.
+// Type is one of "local", "memory" or "s3".
+type StorageConfig struct {
+	Type     string   `json:"type"`
+	LocalDir string   `json:"local_dir,omitempty"`
+	S3       S3Config `json:"s3,omitempty"`
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Type:     "local",
+		LocalDir: "images",
+	}
+}
+
+// Store will build the storage.Store described by the config.
+func (c StorageConfig) Store() (storage.Store, error) {
+	switch strings.ToLower(c.Type) {
+	case "", "local":
+		dir := c.LocalDir
+		if dir == "" {
+			dir = "images"
+		}
+		return storage.NewLocal(dir), nil
+	case "memory":
+		return storage.NewMemory(), nil
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  c.S3.Endpoint,
+			Region:    c.S3.Region,
+			Bucket:    c.S3.Bucket,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+			PathStyle: c.S3.PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", c.Type)
+	}
+}
+
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	PathStyle bool   `json:"path_style"`
+}
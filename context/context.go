@@ -7,7 +7,10 @@ import (
 )
 
 const (
-	userKey privateKey = "user"
+	userKey     privateKey = "user"
+	galleryKey  privateKey = "gallery"
+	apiTokenKey privateKey = "api_token"
+	sessionKey  privateKey = "session"
 )
 
 type privateKey string
@@ -24,3 +27,48 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithGallery is used by middleware.Gallery to pass the gallery
+// it loaded to the handlers.
+func WithGallery(ctx context.Context, gallery *models.Gallery) context.Context {
+	return context.WithValue(ctx, galleryKey, gallery)
+}
+
+func Gallery(ctx context.Context) *models.Gallery {
+	if temp := ctx.Value(galleryKey); temp != nil {
+		if gallery, ok := temp.(*models.Gallery); ok {
+			return gallery
+		}
+	}
+	return nil
+}
+
+// WithAPIToken is used when a request is authenticated with an API
+// token instead of the remember token cookie.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+func APIToken(ctx context.Context) *models.APIToken {
+	if temp := ctx.Value(apiTokenKey); temp != nil {
+		if token, ok := temp.(*models.APIToken); ok {
+			return token
+		}
+	}
+	return nil
+}
+
+// WithSession is used by middleware.User to pass the session the
+// request was authenticated with.
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
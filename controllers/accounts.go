@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+func NewAccounts(users *Users, as models.AccountService) *Accounts {
+	return &Accounts{
+		ConfirmDeletionView: views.NewView("bootstrap", "users/confirm_deletion"),
+		users:               users,
+		as:                  as,
+	}
+}
+
+// Accounts handles exporting and deleting the account of the
+// current user.
+type Accounts struct {
+	ConfirmDeletionView *views.View
+	users               *Users
+	as                  models.AccountService
+}
+
+// DeleteAccountForm is used to confirm deleting the account with
+// the password, or with the token of the link we emailed to users
+// without a password.
+type DeleteAccountForm struct {
+	Password string `schema:"password"`
+	Token    string `schema:"token"`
+}
+
+// Export downloads a ZIP archive of the data we keep about the
+// current user, with the original images of their galleries.
+//
+// GET /account/export
+func (a *Accounts) Export(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	filename := fmt.Sprintf("goweb-learn-%s.zip", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	// The archive is streamed, so once it started all we can do
+	// about an error is to cut it short.
+	if err := a.as.Export(user, w); err != nil {
+		log.Println(err)
+	}
+}
+
+// ScheduleDeletion deletes the account of the current user after
+// models.AccountDeletionGracePeriod, once they entered their
+// password. Their other devices are logged out right away. Users
+// without a password are emailed a link to confirm instead.
+//
+// POST /account/delete
+func (a *Accounts) ScheduleDeletion(w http.ResponseWriter, r *http.Request) {
+	u := a.users
+	user := context.User(r.Context())
+	if !user.HasPassword() {
+		a.initiateDeletion(w, r, user)
+		return
+	}
+	var vd views.Data
+	var form DeleteAccountForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	if err := u.checkLogin(r, user.Email); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	if err := u.us.ScheduleDeletion(user, form.Password); err != nil {
+		if err == models.ErrPasswordIncorrect {
+			u.loginFailed(r, user.Email)
+		}
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	a.deletionScheduled(w, r, user)
+}
+
+// initiateDeletion emails the user a link to confirm the deletion
+// of their account.
+func (a *Accounts) initiateDeletion(w http.ResponseWriter, r *http.Request, user *models.User) {
+	u := a.users
+	var vd views.Data
+	if err := checkEmailRequest(u.limits.MagicLink, "delete", r, user.Email); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	token, err := u.us.InitiateDeletion(user)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	go func(email string) {
+		if err := u.emailer.ConfirmAccountDeletion(email, token); err != nil {
+			log.Println(err)
+		}
+	}(user.Email)
+	views.RedirectAlert(w, r, "/account/settings", http.StatusFound, views.Alert{
+		Level:   views.AlertLvInfo,
+		Message: "We have emailed you a link to confirm the deletion of your account.",
+	})
+}
+
+// ConfirmDeletion asks users who followed the link we emailed them
+// to confirm the deletion of their account. Like login links, the
+// link is only used once they do.
+//
+// GET /account/delete/confirm
+func (a *Accounts) ConfirmDeletion(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form DeleteAccountForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	a.ConfirmDeletionView.Render(w, r, vd)
+}
+
+// CompleteDeletion deletes the account of the current user after
+// models.AccountDeletionGracePeriod, like ScheduleDeletion, once
+// they confirmed with the link we emailed them.
+//
+// POST /account/delete/confirm
+func (a *Accounts) CompleteDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form DeleteAccountForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.ConfirmDeletionView.Render(w, r, vd)
+		return
+	}
+	err := a.users.us.CompleteDeletion(user, form.Token)
+	if err == models.ErrDeletionLinkInvalid {
+		views.RedirectAlert(w, r, "/account/settings", http.StatusFound, views.Alert{
+			Level:   views.AlertLvError,
+			Message: "This link is not valid or has expired. Please ask for a new one.",
+		})
+		return
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		a.ConfirmDeletionView.Render(w, r, vd)
+		return
+	}
+	a.deletionScheduled(w, r, user)
+}
+
+// deletionScheduled logs out the other devices of the user whose
+// account was just scheduled for deletion, and lets them know.
+func (a *Accounts) deletionScheduled(w http.ResponseWriter, r *http.Request, user *models.User) {
+	u := a.users
+	var keep uint
+	if session := context.Session(r.Context()); session != nil {
+		keep = session.ID
+	}
+	if err := u.ss.DeleteByUserID(user.ID, keep); err != nil {
+		log.Println(err)
+	}
+	go func(email string, deleteAt time.Time) {
+		if err := u.emailer.AccountDeletionScheduled(email, deleteAt); err != nil {
+			log.Println(err)
+		}
+	}(user.Email, *user.DeleteAt)
+	views.RedirectAlert(w, r, "/account/settings", http.StatusFound, views.Alert{
+		Level:   views.AlertLvWarning,
+		Message: "Your account will be deleted on " + user.DeleteAt.Format("January 2, 2006") + ". You can still cancel until then.",
+	})
+}
+
+// CancelDeletion keeps the account of the current user.
+//
+// POST /account/delete/cancel
+func (a *Accounts) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := a.users.us.CancelDeletion(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		a.users.renderSettings(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/settings", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Your account will not be deleted.",
+	})
+}
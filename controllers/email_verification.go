@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+// VerifyForm is used to read the token of the links we email to
+// verify email addresses.
+type VerifyForm struct {
+	Token string `schema:"token"`
+}
+
+// sendVerification will email the user a link to verify their
+// email address.
+func (u *Users) sendVerification(user *models.User) error {
+	token, err := u.us.InitiateVerification(user)
+	if err != nil {
+		return err
+	}
+	return u.emailer.VerifyEmail(user.Email, token)
+}
+
+// Verify processes the link we email to verify an email address.
+//
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var form VerifyForm
+	if err := parseURLParams(r, &form); err != nil {
+		views.RedirectAlert(w, r, "/", http.StatusFound, views.Alert{
+			Level:   views.AlertLvError,
+			Message: views.AlertMsgGeneric,
+		})
+		return
+	}
+	if _, err := u.us.CompleteVerification(form.Token); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account", http.StatusFound, *vd.Alert)
+		return
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Thanks, your email address is verified!",
+	})
+}
+
+// ResendVerification emails the current user a new link to verify
+// their email address.
+//
+// POST /account/verify
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.sendVerification(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd, nil)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "We sent you a new link to verify your email address.",
+	})
+}
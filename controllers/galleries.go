@@ -1,14 +1,16 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/email"
 	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/policy"
 	"github.com/monkjunior/goweb.learn/views"
 )
 
@@ -20,26 +22,39 @@ const (
 	maxMultipartMem = 1 << 20
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, ms models.MemberService,
+	us models.UserService, p *policy.Policy, emailer *email.Client, r mux.Router) *Galleries {
 	return &Galleries{
-		NewView:    views.NewView("bootstrap", "galleries/new"),
-		ShowView:   views.NewView("bootstrap", "galleries/show"),
-		UpdateView: views.NewView("bootstrap", "galleries/update"),
-		IndexView:  views.NewView("bootstrap", "galleries/index"),
-		gs:         gs,
-		is:         is,
-		r:          r,
+		NewView:          views.NewView("bootstrap", "galleries/new"),
+		ShowView:         views.NewView("bootstrap", "galleries/show"),
+		UpdateView:       views.NewView("bootstrap", "galleries/update"),
+		IndexView:        views.NewView("bootstrap", "galleries/index"),
+		MembersView:      views.NewView("bootstrap", "galleries/members"),
+		AcceptInviteView: views.NewView("bootstrap", "galleries/accept_invite"),
+		gs:               gs,
+		is:               is,
+		ms:               ms,
+		us:               us,
+		policy:           p,
+		emailer:          emailer,
+		r:                r,
 	}
 }
 
 type Galleries struct {
-	NewView    *views.View
-	ShowView   *views.View
-	UpdateView *views.View
-	IndexView  *views.View
-	gs         models.GalleryService
-	is         models.ImageService
-	r          mux.Router
+	NewView          *views.View
+	ShowView         *views.View
+	UpdateView       *views.View
+	IndexView        *views.View
+	MembersView      *views.View
+	AcceptInviteView *views.View
+	gs               models.GalleryService
+	is               models.ImageService
+	ms               models.MemberService
+	us               models.UserService
+	policy           *policy.Policy
+	emailer          *email.Client
+	r                mux.Router
 }
 
 // New is used to render the form where a user can create
@@ -51,7 +66,20 @@ func (g *Galleries) New(w http.ResponseWriter, r *http.Request) {
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title      string `schema:"title"`
+	Visibility string `schema:"visibility"`
+}
+
+// ShowGalleryParams is used to process the URL params of the
+// show gallery page.
+type ShowGalleryParams struct {
+	Sort string `schema:"sort"`
+}
+
+// GalleryIndex is the data of the galleries index page.
+type GalleryIndex struct {
+	Owned  []models.Gallery
+	Shared []models.Gallery
 }
 
 // Index list all the gallery that user has access to.
@@ -59,33 +87,90 @@ type GalleryForm struct {
 // GET /galleries
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	galleries, err := g.gs.ByUserID(user.ID)
+	owned, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	members, err := g.ms.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	roles := make(map[uint]string, len(members))
+	ids := make([]uint, len(members))
+	for i, m := range members {
+		roles[m.GalleryID] = m.Role
+		ids[i] = m.GalleryID
+	}
+	shared, err := g.gs.ByIDs(ids)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	for i := range owned {
+		owned[i].Role = models.RoleOwner
+	}
+	for i := range shared {
+		shared[i].Role = roles[shared[i].ID]
+	}
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = GalleryIndex{
+		Owned:  owned,
+		Shared: shared,
+	}
 	g.IndexView.Render(w, r, vd)
 }
 
-// Show will look up and show the gallery with specific ID
+// Show will look up and show the gallery with specific ID.
+// Public galleries can be seen without logging in.
 //
 // GET /galleries/:id
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery := context.Gallery(r.Context())
+	g.renderShow(w, r, gallery, "")
+}
+
+// ShowShared will look up and show the gallery with the share
+// token provided in the URL, if the gallery is not private.
+//
+// GET /galleries/shared/:token
+func (g *Galleries) ShowShared(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	gallery, err := g.gs.ByShareToken(token)
 	if err != nil {
-		log.Println(err)
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !gallery.IsShared() {
 		http.Error(w, "Gallery not found", http.StatusNotFound)
 		return
 	}
+	g.renderShow(w, r, gallery, token)
+}
+
+// renderShow will load the images of the gallery and render the
+// show gallery page. The share token, if any, is added to the
+// paths of the images, for visitors who can only see them with it.
+func (g *Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, shareToken string) {
 	images, _ := g.is.ByGalleryID(gallery.ID)
+	for i := range images {
+		images[i].ShareToken = shareToken
+	}
 	gallery.Images = images
+	var params ShowGalleryParams
+	if err := parseURLParams(r, &params); err == nil {
+		gallery.SortImages(params.Sort)
+	}
 	var vd views.Data
 	vd.Yield = gallery
 	g.ShowView.Render(w, r, vd)
@@ -95,21 +180,11 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 //
 // GET /galleries/:id/update
 func (g *Galleries) GetUpdate(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		return
-	}
-
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
-		return
-	}
+	gallery := context.Gallery(r.Context())
 	images, _ := g.is.ByGalleryID(gallery.ID)
 	gallery.Images = images
 	var vd views.Data
 	vd.Yield = gallery
-	vd.User = user
 	g.UpdateView.Render(w, r, vd)
 }
 
@@ -117,16 +192,7 @@ func (g *Galleries) GetUpdate(w http.ResponseWriter, r *http.Request) {
 //
 // POST /galleries/:id/update
 func (g *Galleries) PostUpdate(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		return
-	}
-
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
-		return
-	}
+	gallery := context.Gallery(r.Context())
 	images, _ := g.is.ByGalleryID(gallery.ID)
 	gallery.Images = images
 	var vd views.Data
@@ -137,8 +203,34 @@ func (g *Galleries) PostUpdate(w http.ResponseWriter, r *http.Request) {
 		g.UpdateView.Render(w, r, vd)
 		return
 	}
+	// Only the users who manage members see the visibility field,
+	// since it also decides who can see the gallery.
+	if form.Visibility != "" && form.Visibility != gallery.Visibility {
+		user := context.User(r.Context())
+		_, err := g.policy.Gallery(user, gallery.ID, policy.ActionShare)
+		if err == nil {
+			err = g.policy.Verified(user, policy.ActionShare)
+		}
+		switch err {
+		case nil:
+		case policy.ErrUnverified:
+			views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+				Level:   views.AlertLvWarning,
+				Message: "Please verify your email address first. We can send you a new link below.",
+			})
+			return
+		case policy.ErrNotFound, policy.ErrForbidden:
+			http.Error(w, "You do not have permission to do this", http.StatusForbidden)
+			return
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		gallery.Visibility = form.Visibility
+	}
 	gallery.Title = form.Title
-	err = g.gs.Update(gallery)
+	err := g.gs.Update(gallery)
 	if err != nil {
 		log.Println(err)
 		vd.SetAlert(err)
@@ -152,30 +244,69 @@ func (g *Galleries) PostUpdate(w http.ResponseWriter, r *http.Request) {
 	g.UpdateView.Render(w, r, vd)
 }
 
-// ImageUpload will upload our images the gallery
+// RotateShareToken will replace the share token of the gallery,
+// so that previously shared links stop working.
 //
-// POST /galleries/:id/images
-func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+// POST /galleries/:id/share/rotate
+func (g *Galleries) RotateShareToken(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
+	gallery.ShareToken = ""
+	err := g.gs.Update(gallery)
 	if err != nil {
+		images, _ := g.is.ByGalleryID(gallery.ID)
+		gallery.Images = images
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.UpdateView.Render(w, r, vd)
 		return
 	}
-
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	url, err := g.r.Get(UpdateGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "A new share link has been created. The old link no longer works.",
+	})
+}
 
+// ImageUpload will upload our images the gallery
+//
+// POST /galleries/:id/images
+func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
+	user := context.User(r.Context())
+
+	images, _ := g.is.ByGalleryID(gallery.ID)
+	gallery.Images = images
 	var vd views.Data
 	vd.Yield = gallery
-	err = r.ParseMultipartForm(maxMultipartMem)
+	// Leave some room for the multipart boundaries and other fields.
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxImageUploadBytes+maxMultipartMem)
+	err := r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			err = models.ErrImageUploadTooLarge
+		}
 		vd.SetAlert(err)
 		g.UpdateView.Render(w, r, vd)
 		return
 	}
 
+	var total int64
+	for _, f := range r.MultipartForm.File["images"] {
+		total += f.Size
+	}
+	if total > models.MaxImageUploadBytes {
+		vd.SetAlert(models.ErrImageUploadTooLarge)
+		g.UpdateView.Render(w, r, vd)
+		return
+	}
+
 	for _, f := range r.MultipartForm.File["images"] {
 		file, err := f.Open()
 		if err != nil {
@@ -183,7 +314,13 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 			g.UpdateView.Render(w, r, vd)
 			return
 		}
-		err = g.is.Create(gallery.ID, file, f.Filename)
+		image := models.Image{
+			GalleryID:    gallery.ID,
+			UserID:       user.ID,
+			Filename:     f.Filename,
+			KeepMetadata: user.KeepImageMetadata,
+		}
+		err = g.is.Create(&image, file)
 		if err != nil {
 			vd.SetAlert(err)
 			g.UpdateView.Render(w, r, vd)
@@ -202,24 +339,19 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 //
 // POST /galleries/:id/delete
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		return
-	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
-		return
-	}
+	gallery := context.Gallery(r.Context())
 	var vd views.Data
-	err = g.gs.Delete(gallery.ID)
+	err := g.gs.Delete(gallery.ID)
 	if err != nil {
 		vd.SetAlert(err)
 		vd.Yield = gallery
 		g.UpdateView.Render(w, r, vd)
 		return
 	}
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Gallery moved to the trash. You can restore it from there.",
+	})
 }
 
 // Create is used to process gallery form when a user tries to
@@ -236,8 +368,9 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	user := context.User(r.Context())
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:      form.Title,
+		UserID:     user.ID,
+		Visibility: form.Visibility,
 	}
 	if err := g.gs.Create(&gallery); err != nil {
 		vd.SetAlert(err)
@@ -256,24 +389,22 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 //
 // POST /galleries/:id/images/:filename/delete
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery := context.Gallery(r.Context())
+	filename := mux.Vars(r)["filename"]
+	// Look up the Image model
+	i, err := g.is.ByFilename(gallery.ID, filename)
 	if err != nil {
+		switch err {
+		case models.ErrNotFound, models.ErrFilenameInvalid:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You do not have permission to edit "+
-			"this gallery or image", http.StatusForbidden)
-		return
-	}
-	filename := mux.Vars(r)["filename"]
-	// Build the Image model
-	i := models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
-	}
 	// Try to delete the image.
-	err = g.is.Delete(&i)
+	err = g.is.Delete(i)
 	if err != nil {
 		// Render the edit page with any errors.
 		var vd views.Data
@@ -291,25 +422,3 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
-
-func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
-		return nil, err
-	}
-	gallery, err := g.gs.ByID(uint(id))
-	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			http.Error(w, "Gallery not found", http.StatusNotFound)
-		default:
-			log.Println(err)
-			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
-		}
-		return nil, err
-	}
-	return gallery, nil
-}
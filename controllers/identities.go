@@ -0,0 +1,368 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/middleware"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/oidc"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+// providerLoginDuration is how long users have to log in with an
+// identity provider before we forget they started.
+const providerLoginDuration = 10 * time.Minute
+
+// providerError is the error shown when logging in with an identity
+// provider fails.
+type providerError string
+
+func (e providerError) Error() string {
+	return "controllers: " + string(e)
+}
+
+func (e providerError) Public() string {
+	return string(e)
+}
+
+const (
+	// errProviderLogin is shown when the provider did not log the
+	// user in, without telling why.
+	errProviderLogin      providerError = "We could not log you in with this provider. Please try again."
+	errProviderUnverified providerError = "Your email address is not verified with this provider, so we cannot log you in with it."
+	errProviderUnlinked   providerError = "An account with this email address already exists. Please log in with your password and link this provider from your account page."
+)
+
+func NewIdentities(users *Users, is models.IdentityService, providers []*oidc.Provider) *Identities {
+	return &Identities{
+		IdentitiesView: views.NewView("bootstrap", "users/identities"),
+		users:          users,
+		is:             is,
+		providers:      providers,
+	}
+}
+
+// Identities handles logging in with identity providers and linking
+// accounts there to our users.
+type Identities struct {
+	IdentitiesView *views.View
+	users          *Users
+	is             models.IdentityService
+	providers      []*oidc.Provider
+}
+
+// providerLogin is the state of a login with an identity provider,
+// kept in a cookie until the provider sends the user back.
+type providerLogin struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// Link is set when a logged in user links an account rather
+	// than logging in.
+	Link bool `json:"link"`
+}
+
+// provider returns the provider named in the URL, or nil after
+// responding with a 404.
+func (i *Identities) provider(w http.ResponseWriter, r *http.Request) *oidc.Provider {
+	name := mux.Vars(r)["provider"]
+	for _, p := range i.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	http.Error(w, "Provider not found", http.StatusNotFound)
+	return nil
+}
+
+// Login sends the user to the identity provider to log in.
+//
+// GET /auth/:provider
+func (i *Identities) Login(w http.ResponseWriter, r *http.Request) {
+	p := i.provider(w, r)
+	if p == nil {
+		return
+	}
+	if err := i.start(w, r, p, false); err != nil {
+		log.Println(err)
+		var vd views.Data
+		vd.SetAlert(errProviderLogin)
+		i.users.renderLogin(w, r, vd)
+	}
+}
+
+// Link sends the current user to the identity provider, to link
+// their account there.
+//
+// POST /account/identities/:provider
+func (i *Identities) Link(w http.ResponseWriter, r *http.Request) {
+	p := i.provider(w, r)
+	if p == nil {
+		return
+	}
+	if err := i.start(w, r, p, true); err != nil {
+		log.Println(err)
+		var vd views.Data
+		vd.SetAlert(errProviderLogin)
+		i.render(w, r, vd)
+	}
+}
+
+// start will remember a new login with the provider in a cookie and
+// redirect the user to it.
+func (i *Identities) start(w http.ResponseWriter, r *http.Request, p *oidc.Provider, link bool) error {
+	login := providerLogin{Provider: p.Name, Link: link}
+	for _, v := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		var err error
+		if *v, err = oidc.NewState(); err != nil {
+			return err
+		}
+	}
+	authURL, err := p.AuthURL(r.Context(), login.State, login.Nonce, login.Verifier)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	i.users.cookie.SetProvider(w, value, time.Now().Add(providerLoginDuration))
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// pendingLogin reads the login the cookie remembers, and checks the
+// provider sent the user back for it.
+func (i *Identities) pendingLogin(r *http.Request, p *oidc.Provider) (*providerLogin, bool) {
+	cookie, err := r.Cookie(middleware.ProviderCookieName)
+	if err != nil {
+		return nil, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, false
+	}
+	var login providerLogin
+	if err := json.Unmarshal(b, &login); err != nil {
+		return nil, false
+	}
+	if login.Provider != p.Name || login.State == "" || login.State != r.FormValue("state") {
+		return nil, false
+	}
+	return &login, true
+}
+
+// Callback is where the identity provider sends users back to. It
+// either links the account to the current user, or logs in its
+// user, creating one on their first login.
+//
+// GET /auth/:provider/callback
+func (i *Identities) Callback(w http.ResponseWriter, r *http.Request) {
+	p := i.provider(w, r)
+	if p == nil {
+		return
+	}
+	login, ok := i.pendingLogin(r, p)
+	i.users.cookie.ClearProvider(w)
+	if !ok {
+		views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+			Level:   views.AlertLvWarning,
+			Message: "Your login has expired. Please log in again.",
+		})
+		return
+	}
+	user := context.User(r.Context())
+	if login.Link && user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	var claims *oidc.Claims
+	err := error(errProviderLogin)
+	if r.FormValue("error") == "" {
+		claims, err = p.Exchange(r.Context(), r.FormValue("code"), login.Nonce, login.Verifier)
+		if err != nil {
+			log.Println(err)
+			err = errProviderLogin
+		}
+	}
+	if err == nil && login.Link {
+		err = i.link(user, p, claims)
+		if err == nil {
+			views.RedirectAlert(w, r, "/account/identities", http.StatusFound, views.Alert{
+				Level:   views.AlertLvSuccess,
+				Message: "Your " + p.DisplayName + " account has been linked.",
+			})
+			return
+		}
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		if login.Link {
+			i.render(w, r, vd)
+		} else {
+			i.users.renderLogin(w, r, vd)
+		}
+		return
+	}
+
+	user, err = i.userFor(p, claims)
+	if err == nil && user.TOTPEnabled {
+		if err = i.users.startSecondFactor(w, r, user); err == nil {
+			http.Redirect(w, r, "/login/2fa", http.StatusFound)
+			return
+		}
+	}
+	if err == nil {
+		err = i.users.signIn(w, r, user)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		i.users.renderLogin(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// link will link the account with the provider to the user.
+func (i *Identities) link(user *models.User, p *oidc.Provider, claims *oidc.Claims) error {
+	return i.is.Create(&models.Identity{
+		UserID:   user.ID,
+		Provider: p.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	})
+}
+
+// userFor returns the user to log in with the account at the
+// provider. Accounts seen for the first time are linked to the user
+// with the same email address, but only when both the provider and
+// the user verified it, or else anyone could take over an account
+// by signing up elsewhere with its email address. If there is no
+// such user, a new one is created without a password.
+func (i *Identities) userFor(p *oidc.Provider, claims *oidc.Claims) (*models.User, error) {
+	identity, err := i.is.ByProviderSubject(p.Name, claims.Subject)
+	if err == nil {
+		return i.users.us.ByID(identity.UserID)
+	}
+	if err != models.ErrNotFound {
+		return nil, err
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errProviderUnverified
+	}
+
+	user, err := i.users.us.ByEmail(claims.Email)
+	switch err {
+	case nil:
+		if !user.Verified() {
+			return nil, errProviderUnlinked
+		}
+	case models.ErrNotFound:
+		now := time.Now()
+		user = &models.User{
+			Name:       claims.Name,
+			Email:      claims.Email,
+			VerifiedAt: &now,
+		}
+		if err := i.users.us.CreatePasswordless(user); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	if err := i.link(user, p, claims); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// IdentitiesPage is the data of the page listing the linked
+// accounts of the current user.
+type IdentitiesPage struct {
+	Identities []Identity
+	// Providers are the providers the user can still link.
+	Providers   []*oidc.Provider
+	HasPassword bool
+}
+
+// Identity is a linked account, with the provider shown by name.
+type Identity struct {
+	models.Identity
+	ProviderName string
+}
+
+// Index lists the accounts linked to the current user.
+//
+// GET /account/identities
+func (i *Identities) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	i.render(w, r, vd)
+}
+
+func (i *Identities) render(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	identities, err := i.is.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	page := IdentitiesPage{HasPassword: user.HasPassword()}
+	linked := make(map[string]bool)
+	for _, identity := range identities {
+		name := identity.Provider
+		for _, p := range i.providers {
+			if p.Name == identity.Provider {
+				name = p.DisplayName
+			}
+		}
+		linked[identity.Provider] = true
+		page.Identities = append(page.Identities, Identity{Identity: identity, ProviderName: name})
+	}
+	for _, p := range i.providers {
+		if !linked[p.Name] {
+			page.Providers = append(page.Providers, p)
+		}
+	}
+	vd.Yield = page
+	i.IdentitiesView.Render(w, r, vd)
+}
+
+// Unlink removes a linked account of the current user.
+//
+// POST /account/identities/:id/delete
+func (i *Identities) Unlink(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	err = i.is.Unlink(user, uint(id))
+	if err == models.ErrNotFound {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		i.render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/identities", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "The account has been unlinked.",
+	})
+}
@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/middleware"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/oidc"
+	"github.com/monkjunior/goweb.learn/oidc/oidctest"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+type fakeUsers struct {
+	models.UserService
+	users []*models.User
+}
+
+func (fu *fakeUsers) ByID(id uint) (*models.User, error) {
+	for _, user := range fu.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fu *fakeUsers) ByEmail(email string) (*models.User, error) {
+	for _, user := range fu.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fu *fakeUsers) CreatePasswordless(user *models.User) error {
+	user.ID = uint(len(fu.users) + 1)
+	fu.users = append(fu.users, user)
+	return nil
+}
+
+type fakeIdentities struct {
+	models.IdentityService
+	identities []models.Identity
+}
+
+func (fi *fakeIdentities) ByProviderSubject(provider, subject string) (*models.Identity, error) {
+	for _, identity := range fi.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fi *fakeIdentities) Create(identity *models.Identity) error {
+	identity.ID = uint(len(fi.identities) + 1)
+	fi.identities = append(fi.identities, *identity)
+	return nil
+}
+
+// fakeSessions records the users it creates sessions for.
+type fakeSessions struct {
+	models.SessionService
+	userIDs []uint
+}
+
+func (fs *fakeSessions) Create(session *models.Session) error {
+	session.Token = "token"
+	session.ExpiresAt = time.Now().Add(time.Hour)
+	fs.userIDs = append(fs.userIDs, session.UserID)
+	return nil
+}
+
+func verifiedUser(id uint, email string) *models.User {
+	now := time.Now()
+	user := models.User{Email: email, VerifiedAt: &now}
+	user.ID = id
+	return &user
+}
+
+// identitiesTest is the app with one provider, the fake one of the
+// test, and fake services.
+type identitiesTest struct {
+	srv        *oidctest.Server
+	handler    http.Handler
+	users      *fakeUsers
+	identities *fakeIdentities
+	sessions   *fakeSessions
+}
+
+func newIdentitiesTest(users []*models.User, identities []models.Identity) *identitiesTest {
+	views.TemplateDir = "../views/"
+	views.LayoutDir = "../views/layouts/"
+
+	srv := oidctest.NewServer("client", "secret")
+	p := oidc.New(oidc.Config{
+		Name:         "test",
+		DisplayName:  "Test",
+		Issuer:       srv.URL,
+		ClientID:     srv.ClientID,
+		ClientSecret: srv.ClientSecret,
+		RedirectURL:  "http://localhost:3000/auth/test/callback",
+	})
+	providers := []*oidc.Provider{p}
+	it := &identitiesTest{
+		srv:        srv,
+		users:      &fakeUsers{users: users},
+		identities: &fakeIdentities{identities: identities},
+		sessions:   &fakeSessions{},
+	}
+	usersC := NewUsers(it.users, it.sessions, nil, nil, nil, middleware.SessionCookie{}, LoginLimits{}, providers)
+	identitiesC := NewIdentities(usersC, it.identities, providers)
+	r := mux.NewRouter()
+	r.HandleFunc("/auth/{provider}", identitiesC.Login).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", identitiesC.Callback).Methods("GET")
+	it.handler = r
+	return it
+}
+
+// login logs in with the provider, like a browser following the
+// redirects would, and returns the response to the callback.
+func (it *identitiesTest) login(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	it.handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/test", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d", w.Code, http.StatusFound)
+	}
+	callback, err := it.srv.Login(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", callback.RequestURI(), nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	it.handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestCallback(t *testing.T) {
+	claims := func(email string, verified bool) map[string]interface{} {
+		return map[string]interface{}{
+			"sub":            "1234",
+			"email":          email,
+			"email_verified": verified,
+			"name":           "Jon Calhoun",
+		}
+	}
+	unverified := verifiedUser(1, "jon@example.com")
+	unverified.VerifiedAt = nil
+
+	tests := []struct {
+		name       string
+		users      []*models.User
+		identities []models.Identity
+		claims     map[string]interface{}
+		// loggedIn is the user logged in, or zero if the login
+		// page is shown with the alert.
+		loggedIn uint
+		alert    string
+		// linked is the user the account is linked to, if any.
+		linked uint
+	}{
+		{
+			name:     "first login signs up",
+			users:    []*models.User{verifiedUser(1, "bob@example.com")},
+			claims:   claims("jon@example.com", true),
+			loggedIn: 2,
+			linked:   2,
+		},
+		{
+			name:     "links to the user with the verified email",
+			users:    []*models.User{verifiedUser(1, "jon@example.com")},
+			claims:   claims("Jon@Example.com", true),
+			loggedIn: 1,
+			linked:   1,
+		},
+		{
+			name:       "logs in the user of a linked account",
+			users:      []*models.User{verifiedUser(1, "bob@example.com"), verifiedUser(2, "jon@example.com")},
+			identities: []models.Identity{{UserID: 1, Provider: "test", Subject: "1234"}},
+			claims:     claims("jon@example.com", true),
+			loggedIn:   1,
+			linked:     1,
+		},
+		{
+			name:   "refuses an unverified email",
+			users:  []*models.User{verifiedUser(1, "jon@example.com")},
+			claims: claims("jon@example.com", false),
+			alert:  errProviderUnverified.Public(),
+		},
+		{
+			name:   "refuses no email",
+			claims: map[string]interface{}{"sub": "1234"},
+			alert:  errProviderUnverified.Public(),
+		},
+		{
+			name:   "refuses to link to an unverified user",
+			users:  []*models.User{unverified},
+			claims: claims("jon@example.com", true),
+			alert:  errProviderUnlinked.Public(),
+		},
+		{
+			name:   "refuses a nonce mismatch",
+			claims: map[string]interface{}{"sub": "1234", "email": "jon@example.com", "email_verified": true, "nonce": "other"},
+			alert:  errProviderLogin.Public(),
+		},
+		{
+			name:   "refuses an aud mismatch",
+			claims: map[string]interface{}{"sub": "1234", "email": "jon@example.com", "email_verified": true, "aud": "other"},
+			alert:  errProviderLogin.Public(),
+		},
+		{
+			name:   "refuses an iss mismatch",
+			claims: map[string]interface{}{"sub": "1234", "email": "jon@example.com", "email_verified": true, "iss": "https://evil.example.com"},
+			alert:  errProviderLogin.Public(),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			it := newIdentitiesTest(tc.users, tc.identities)
+			defer it.srv.Close()
+			it.srv.Claims = tc.claims
+			usersBefore := len(it.users.users)
+
+			w := it.login(t)
+			if tc.loggedIn == 0 {
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+				}
+				if body := w.Body.String(); !strings.Contains(body, html.EscapeString(tc.alert)) {
+					t.Fatalf("got login page without alert %q", tc.alert)
+				}
+				if len(it.sessions.userIDs) != 0 {
+					t.Fatalf("got sessions for users %v, want none", it.sessions.userIDs)
+				}
+				if len(it.users.users) != usersBefore {
+					t.Fatalf("got %d users, want %d", len(it.users.users), usersBefore)
+				}
+			} else {
+				if w.Code != http.StatusFound || w.Header().Get("Location") != "/galleries" {
+					t.Fatalf("got status %d to %q, want %d to /galleries", w.Code, w.Header().Get("Location"), http.StatusFound)
+				}
+				if len(it.sessions.userIDs) != 1 || it.sessions.userIDs[0] != tc.loggedIn {
+					t.Fatalf("got sessions for users %v, want [%d]", it.sessions.userIDs, tc.loggedIn)
+				}
+			}
+
+			identity, err := it.identities.ByProviderSubject("test", "1234")
+			switch {
+			case tc.linked == 0 && err == nil:
+				t.Fatalf("got account linked to user %d, want it unlinked", identity.UserID)
+			case tc.linked != 0 && err != nil:
+				t.Fatalf("got account unlinked, want it linked to user %d", tc.linked)
+			case tc.linked != 0 && identity.UserID != tc.linked:
+				t.Fatalf("got account linked to user %d, want %d", identity.UserID, tc.linked)
+			}
+		})
+	}
+}
+
+func TestCallbackSignUp(t *testing.T) {
+	it := newIdentitiesTest(nil, nil)
+	defer it.srv.Close()
+	it.srv.Claims = map[string]interface{}{
+		"sub":            "1234",
+		"email":          "Jon@Example.com",
+		"email_verified": "true",
+		"name":           "Jon Calhoun",
+	}
+	if w := it.login(t); w.Code != http.StatusFound {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusFound)
+	}
+	if len(it.users.users) != 1 {
+		t.Fatalf("got %d users, want 1", len(it.users.users))
+	}
+	user := it.users.users[0]
+	if user.Email != "jon@example.com" || user.Name != "Jon Calhoun" {
+		t.Fatalf("got user %q <%s>, want %q <%s>", user.Name, user.Email, "Jon Calhoun", "jon@example.com")
+	}
+	if !user.Verified() {
+		t.Fatal("got an unverified user, want the email verified by the provider")
+	}
+	if user.HasPassword() {
+		t.Fatal("got a user with a password, want none")
+	}
+}
+
+func TestCallbackStateMismatch(t *testing.T) {
+	it := newIdentitiesTest(nil, nil)
+	defer it.srv.Close()
+	w := httptest.NewRecorder()
+	it.handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/test", nil))
+	callback, err := it.srv.Login(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := callback.Query()
+	q.Set("state", "other")
+
+	req := httptest.NewRequest("GET", callback.Path+"?"+q.Encode(), nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	it.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login" {
+		t.Fatalf("got status %d to %q, want %d to /login", w.Code, w.Header().Get("Location"), http.StatusFound)
+	}
+	if len(it.users.users) != 0 || len(it.sessions.userIDs) != 0 {
+		t.Fatal("got a user logged in, want the login refused")
+	}
+}
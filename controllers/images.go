@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/policy"
+	"github.com/monkjunior/goweb.learn/storage"
+)
+
+var (
+	// imageKeyRegex matches the keys of original images, eg:
+	// galleries/12/0123456789abcdef0123456789abcdef.jpg
+	imageKeyRegex = regexp.MustCompile(`^galleries/([0-9]+)/([^/]+)$`)
+	// variantKeyRegex matches the keys of resized image variants, eg:
+	// galleries/12/thumb/0123456789abcdef0123456789abcdef.jpg
+	variantKeyRegex = regexp.MustCompile(`^galleries/([0-9]+)/([a-z]+)/([^/]+)$`)
+)
+
+func NewImages(is models.ImageService, p *policy.Policy) *Images {
+	return &Images{
+		is:     is,
+		policy: p,
+	}
+}
+
+// Images serves the image files kept in our storage.Store. It is
+// meant to be used with http.StripPrefix. Only images that have a
+// record outside of the trash are served, to the users who may see
+// their gallery or who have its share token.
+type Images struct {
+	is     models.ImageService
+	policy *policy.Policy
+}
+
+// ServeHTTP will serve the requested image, generating resized
+// variants that are missing from the store on the way. Images the
+// current user may not see are not found.
+//
+// GET /images/*
+func (i *Images) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rc, obj, err := i.open(r)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound, models.ErrFilenameInvalid, policy.ErrNotFound, policy.ErrForbidden:
+		default:
+			log.Println(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	storage.ServeObject(w, r, rc, obj)
+}
+
+// open will open the image or variant requested, once the current
+// user is authorized to see it.
+func (i *Images) open(r *http.Request) (io.ReadCloser, *storage.Object, error) {
+	image, size, err := i.image(r.URL.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	user := context.User(r.Context())
+	err = i.policy.Authorize(user, policy.ActionView, image)
+	if err == policy.ErrNotFound {
+		// Unlisted galleries show their images with the share
+		// token, so rotating it revokes their URLs too.
+		err = i.policy.SharedImage(r.URL.Query().Get("share"), image)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if size == "" {
+		return i.is.Open(image)
+	}
+	return i.is.OpenVariant(image, size)
+}
+
+// image will look up the image stored under key, along with the
+// size of the variant requested, which is empty for originals.
+func (i *Images) image(key string) (*models.Image, string, error) {
+	if m := imageKeyRegex.FindStringSubmatch(key); m != nil {
+		galleryID, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, "", models.ErrNotFound
+		}
+		image, err := i.is.ByFilename(uint(galleryID), m[2])
+		return image, "", err
+	}
+	if m := variantKeyRegex.FindStringSubmatch(key); m != nil {
+		galleryID, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, "", models.ErrNotFound
+		}
+		image, err := i.is.ByVariantFilename(uint(galleryID), m[3])
+		return image, m[2], err
+	}
+	return nil, "", models.ErrNotFound
+}
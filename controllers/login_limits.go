@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/middleware"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/throttle"
+)
+
+// LoginLimits slow down password guessing and the password reset
+// and login link emails one can request. Failed logins are counted
+// by email address and by IP, and so are the emails requested.
+type LoginLimits struct {
+	Account   *throttle.Limiter
+	IP        *throttle.Limiter
+	Reset     *throttle.Limiter
+	MagicLink *throttle.Limiter
+}
+
+// DefaultLoginLimits returns the limits we use, counting in store.
+// Accounts are locked for 15 minutes after 10 failed logins.
+func DefaultLoginLimits(store throttle.Store) LoginLimits {
+	return LoginLimits{
+		Account: throttle.New(store, throttle.Config{
+			Free:      5,
+			Delay:     time.Second,
+			MaxDelay:  time.Minute,
+			LockAfter: 10,
+			LockFor:   15 * time.Minute,
+			Window:    time.Hour,
+		}),
+		IP: throttle.New(store, throttle.Config{
+			Free:     20,
+			Delay:    time.Second,
+			MaxDelay: 5 * time.Minute,
+			Window:   time.Hour,
+		}),
+		Reset: throttle.New(store, throttle.Config{
+			Free:     3,
+			Delay:    time.Minute,
+			MaxDelay: time.Hour,
+			Window:   24 * time.Hour,
+		}),
+		MagicLink: throttle.New(store, throttle.Config{
+			Free:     3,
+			Delay:    time.Minute,
+			MaxDelay: time.Hour,
+			Window:   24 * time.Hour,
+		}),
+	}
+}
+
+// tooManyAttempts is the error shown while users must wait before
+// trying again.
+type tooManyAttempts time.Duration
+
+func (e tooManyAttempts) Error() string {
+	return "controllers: too many attempts"
+}
+
+func (e tooManyAttempts) Public() string {
+	d := time.Duration(e)
+	if d < time.Minute {
+		return fmt.Sprintf("Too many attempts. Please try again in %d seconds.", int(d.Seconds())+1)
+	}
+	return fmt.Sprintf("Too many attempts. Please try again in %d minutes.", int(d.Minutes())+1)
+}
+
+// loginKeys returns the keys failed logins are counted under.
+func loginKeys(r *http.Request, email string) (account, ip string) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	return "login:email:" + email, "login:ip:" + middleware.RemoteIP(r)
+}
+
+// checkLogin returns a tooManyAttempts error if logging in with the
+// email must wait.
+func (u *Users) checkLogin(r *http.Request, email string) error {
+	account, ip := loginKeys(r, email)
+	accountWait, err := u.limits.Account.Wait(account)
+	if err != nil {
+		return err
+	}
+	ipWait, err := u.limits.IP.Wait(ip)
+	if err != nil {
+		return err
+	}
+	return waitError(accountWait, ipWait)
+}
+
+// loginFailed records a failed login. When it locks the account
+// we let its owner know, if there is one.
+func (u *Users) loginFailed(r *http.Request, email string) {
+	account, ip := loginKeys(r, email)
+	if _, err := u.limits.IP.Fail(ip); err != nil {
+		log.Println(err)
+	}
+	res, err := u.limits.Account.Fail(account)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !res.Locked {
+		return
+	}
+	user, err := u.us.ByEmail(email)
+	if err != nil {
+		if err != models.ErrNotFound {
+			log.Println(err)
+		}
+		return
+	}
+	if err := u.emailer.AccountLocked(user.Email, res.Wait); err != nil {
+		log.Println(err)
+	}
+}
+
+// loginSucceeded forgets the failed logins of the account. Those of
+// the IP are kept, or logging into your own account would let you
+// keep guessing the passwords of others.
+func (u *Users) loginSucceeded(r *http.Request, email string) {
+	account, _ := loginKeys(r, email)
+	if err := u.limits.Account.Reset(account); err != nil {
+		log.Println(err)
+	}
+}
+
+// checkReset returns a tooManyAttempts error if a reset email for
+// the address cannot be sent yet, otherwise the request is counted.
+func (u *Users) checkReset(r *http.Request, email string) error {
+	return checkEmailRequest(u.limits.Reset, "reset", r, email)
+}
+
+// checkMagicLink returns a tooManyAttempts error if a login link
+// for the address cannot be sent yet, otherwise the request is
+// counted.
+func (u *Users) checkMagicLink(r *http.Request, email string) error {
+	return checkEmailRequest(u.limits.MagicLink, "magic", r, email)
+}
+
+// checkEmailRequest counts a request for an email to the address
+// with the limiter, by address and by IP, unless one of them must
+// wait.
+func checkEmailRequest(limiter *throttle.Limiter, prefix string, r *http.Request, email string) error {
+	keys := []string{
+		prefix + ":email:" + strings.ToLower(strings.TrimSpace(email)),
+		prefix + ":ip:" + middleware.RemoteIP(r),
+	}
+	var waits []time.Duration
+	for _, key := range keys {
+		d, err := limiter.Wait(key)
+		if err != nil {
+			return err
+		}
+		waits = append(waits, d)
+	}
+	if err := waitError(waits...); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := limiter.Fail(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitError returns a tooManyAttempts error for the longest of the
+// waits, or nil if there is nothing to wait for.
+func waitError(waits ...time.Duration) error {
+	var longest time.Duration
+	for _, d := range waits {
+		if d > longest {
+			longest = d
+		}
+	}
+	if longest > 0 {
+		return tooManyAttempts(longest)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+// MagicLinkForm is used to request a login link, and to log in
+// with the token of the link.
+type MagicLinkForm struct {
+	Email string `schema:"email"`
+	Token string `schema:"token"`
+}
+
+// InitiateMagicLink emails a link to log in without a password.
+//
+// POST /login/email
+func (u *Users) InitiateMagicLink(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form MagicLinkForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.MagicLinkView.Render(w, r, vd)
+		return
+	}
+	if err := u.checkMagicLink(r, form.Email); err != nil {
+		vd.SetAlert(err)
+		u.MagicLinkView.Render(w, r, vd)
+		return
+	}
+	// Like password resets, the response does not tell whether
+	// there is an account with the email.
+	token, err := u.us.InitiateMagicLink(form.Email)
+	switch err {
+	case nil:
+		go func(email string) {
+			if err := u.emailer.MagicLink(email, token); err != nil {
+				log.Println(err)
+			}
+		}(form.Email)
+	case models.ErrNotFound:
+	default:
+		vd.SetAlert(err)
+		u.MagicLinkView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "If there is an account with this email address, we have emailed it a link to log in.",
+	})
+}
+
+// MagicLogin asks users who followed a login link to confirm. The
+// link is only used once they do, since email scanners open links
+// on their own.
+//
+// GET /login/magic
+func (u *Users) MagicLogin(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form MagicLinkForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	u.MagicLoginView.Render(w, r, vd)
+}
+
+// CompleteMagicLink logs in the user the login link was sent to.
+//
+// POST /login/magic
+func (u *Users) CompleteMagicLink(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form MagicLinkForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.MagicLoginView.Render(w, r, vd)
+		return
+	}
+	user, err := u.us.CompleteMagicLink(form.Token)
+	if err == models.ErrMagicLinkInvalid {
+		views.RedirectAlert(w, r, "/login/email", http.StatusFound, views.Alert{
+			Level:   views.AlertLvError,
+			Message: "This login link is not valid or has expired. Please ask for a new one.",
+		})
+		return
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		u.MagicLoginView.Render(w, r, vd)
+		return
+	}
+	// Owning the email address is a good reason to unlock the
+	// account, as with password resets.
+	u.loginSucceeded(r, user.Email)
+	// The link alone is not enough to get past two-factor
+	// authentication.
+	if user.TOTPEnabled {
+		if err := u.startSecondFactor(w, r, user); err != nil {
+			vd.SetAlert(err)
+			u.MagicLoginView.Render(w, r, vd)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.MagicLoginView.Render(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+// MembersPage is the data of the gallery members page.
+type MembersPage struct {
+	Gallery *models.Gallery
+	Owner   *models.User
+	Members []MemberRow
+	Roles   []string
+	Invite  InviteForm
+}
+
+// MemberRow is a member of a gallery along with their user.
+type MemberRow struct {
+	models.Member
+	User *models.User
+}
+
+// InviteForm is used to process the invite member form.
+type InviteForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// MemberForm is used to process the change role form.
+type MemberForm struct {
+	Role string `schema:"role"`
+}
+
+// AcceptInviteForm is used to process the accept invite form.
+type AcceptInviteForm struct {
+	Token string `schema:"token"`
+}
+
+// AcceptInvitePage is the data of the accept invite page. Gallery
+// is nil when the invitation could not be found.
+type AcceptInvitePage struct {
+	Token   string
+	Role    string
+	Gallery *models.Gallery
+}
+
+// Members lists who has access to a gallery.
+//
+// GET /galleries/:id/members
+func (g *Galleries) Members(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
+	var vd views.Data
+	if err := g.membersPage(&vd, gallery, InviteForm{}); err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.MembersView.Render(w, r, vd)
+}
+
+// InviteMember emails an invitation to join the gallery.
+//
+// POST /galleries/:id/members
+func (g *Galleries) InviteMember(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
+	var vd views.Data
+	var form InviteForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderMembers(w, r, vd, gallery, form, err)
+		return
+	}
+	token, err := g.ms.Invite(gallery.ID, form.Email, form.Role)
+	if err != nil {
+		g.renderMembers(w, r, vd, gallery, form, err)
+		return
+	}
+	user := context.User(r.Context())
+	err = g.emailer.InviteToGallery(form.Email, user.Name, gallery.Title, form.Role, token)
+	if err != nil {
+		g.renderMembers(w, r, vd, gallery, form, err)
+		return
+	}
+	views.RedirectAlert(w, r, g.membersPath(gallery), http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "An invitation has been emailed to " + form.Email + ".",
+	})
+}
+
+// UpdateMember changes the role of a member.
+//
+// POST /galleries/:id/members/:memberID/update
+func (g *Galleries) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	gallery, member, ok := g.galleryMember(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderMembers(w, r, vd, gallery, InviteForm{}, err)
+		return
+	}
+	member.Role = form.Role
+	if err := g.ms.Update(member); err != nil {
+		g.renderMembers(w, r, vd, gallery, InviteForm{}, err)
+		return
+	}
+	views.RedirectAlert(w, r, g.membersPath(gallery), http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "The role has been updated.",
+	})
+}
+
+// RemoveMember takes away the access of a member to the gallery.
+//
+// POST /galleries/:id/members/:memberID/delete
+func (g *Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	gallery, member, ok := g.galleryMember(w, r)
+	if !ok {
+		return
+	}
+	if err := g.ms.Delete(member.ID); err != nil {
+		var vd views.Data
+		g.renderMembers(w, r, vd, gallery, InviteForm{}, err)
+		return
+	}
+	views.RedirectAlert(w, r, g.membersPath(gallery), http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "The member has been removed.",
+	})
+}
+
+// GetAcceptInvite displays the invitation the user is about to
+// accept, using the token provided via the URL query params.
+//
+// GET /invites/accept
+func (g *Galleries) GetAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AcceptInviteForm
+	vd.Yield = AcceptInvitePage{}
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.AcceptInviteView.Render(w, r, vd)
+		return
+	}
+	inv, err := g.ms.InviteByToken(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		g.AcceptInviteView.Render(w, r, vd)
+		return
+	}
+	gallery, err := g.gs.ByID(inv.GalleryID)
+	if err != nil {
+		vd.SetAlert(err)
+		g.AcceptInviteView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = AcceptInvitePage{
+		Token:   form.Token,
+		Role:    inv.Role,
+		Gallery: gallery,
+	}
+	g.AcceptInviteView.Render(w, r, vd)
+}
+
+// AcceptInvite makes the current user a member of the gallery
+// they were invited to.
+//
+// POST /invites/accept
+func (g *Galleries) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AcceptInviteForm
+	vd.Yield = AcceptInvitePage{}
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.AcceptInviteView.Render(w, r, vd)
+		return
+	}
+	user := context.User(r.Context())
+	member, err := g.ms.AcceptInvite(form.Token, user)
+	if err != nil {
+		vd.SetAlert(err)
+		g.AcceptInviteView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(ShowGallery).URL("id", strconv.Itoa(int(member.GalleryID)))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "You are now a " + member.Role + " of this gallery.",
+	})
+}
+
+// galleryMember will look up the member from the URL, making sure
+// it belongs to the gallery loaded by middleware.Gallery. If
+// anything fails an error is written and ok is false.
+func (g *Galleries) galleryMember(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Member, bool) {
+	gallery := context.Gallery(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["memberID"])
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	member, err := g.ms.ByID(uint(id))
+	if err == nil && member.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	switch err {
+	case nil:
+		return gallery, member, true
+	case models.ErrNotFound:
+		http.Error(w, "Member not found", http.StatusNotFound)
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+	}
+	return nil, nil, false
+}
+
+// renderMembers will render the members page with an alert for err.
+func (g *Galleries) renderMembers(w http.ResponseWriter, r *http.Request, vd views.Data,
+	gallery *models.Gallery, form InviteForm, err error) {
+	vd.SetAlert(err)
+	if err := g.membersPage(&vd, gallery, form); err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.MembersView.Render(w, r, vd)
+}
+
+// membersPage will load everything the members page shows into vd.
+func (g *Galleries) membersPage(vd *views.Data, gallery *models.Gallery, form InviteForm) error {
+	owner, err := g.us.ByID(gallery.UserID)
+	if err != nil {
+		return err
+	}
+	members, err := g.ms.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	rows := make([]MemberRow, 0, len(members))
+	for _, m := range members {
+		user, err := g.us.ByID(m.UserID)
+		if err == models.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rows = append(rows, MemberRow{Member: m, User: user})
+	}
+	if form.Role == "" {
+		form.Role = models.RoleViewer
+	}
+	vd.Yield = MembersPage{
+		Gallery: gallery,
+		Owner:   owner,
+		Members: rows,
+		Roles:   models.Roles,
+		Invite:  form,
+	}
+	return nil
+}
+
+func (g *Galleries) membersPath(gallery *models.Gallery) string {
+	return "/galleries/" + strconv.Itoa(int(gallery.ID)) + "/members"
+}
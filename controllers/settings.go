@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+// SettingsForm is used to process the forms of the account settings
+// page. Password is the current password, asked for before changing
+// the email address or the password.
+type SettingsForm struct {
+	Name        string `schema:"name"`
+	Email       string `schema:"email"`
+	Password    string `schema:"password"`
+	NewPassword string `schema:"new_password"`
+}
+
+// Settings displays the forms to change the name, email address and
+// password of the current user.
+//
+// GET /account/settings
+func (u *Users) Settings(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	u.renderSettings(w, r, vd)
+}
+
+func (u *Users) renderSettings(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	vd.Yield = context.User(r.Context())
+	u.SettingsView.Render(w, r, vd)
+}
+
+// UpdateName changes the name of the current user.
+//
+// POST /account/settings/name
+func (u *Users) UpdateName(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form SettingsForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	user.Name = strings.TrimSpace(form.Name)
+	if err := u.us.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/settings", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Your name has been updated.",
+	})
+}
+
+// ChangeEmail changes the email address of the current user once
+// they entered their password. The new address must be verified
+// again, and the old one is told about the change.
+//
+// POST /account/settings/email
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form SettingsForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	oldEmail := user.Email
+	if err := u.checkLogin(r, oldEmail); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	if err := u.us.ChangeEmail(user, form.Password, form.Email); err != nil {
+		if err == models.ErrPasswordIncorrect {
+			u.loginFailed(r, oldEmail)
+		}
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	if user.Email == oldEmail {
+		http.Redirect(w, r, "/account/settings", http.StatusFound)
+		return
+	}
+	u.notifyChange(oldEmail, "email address")
+	if err := u.sendVerification(user); err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/account/settings", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Your email address has been changed. Please follow the link we emailed to the new address to verify it.",
+	})
+}
+
+// ChangePassword changes the password of the current user once they
+// entered the current one, and logs out their other devices.
+//
+// POST /account/settings/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form SettingsForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	if err := u.checkLogin(r, user.Email); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	if err := u.us.ChangePassword(user, form.Password, form.NewPassword); err != nil {
+		if err == models.ErrPasswordIncorrect {
+			u.loginFailed(r, user.Email)
+		}
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	// Whoever knew the old password may still be logged in.
+	var keep uint
+	if session := context.Session(r.Context()); session != nil {
+		keep = session.ID
+	}
+	if err := u.ss.DeleteByUserID(user.ID, keep); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd)
+		return
+	}
+	u.notifyChange(user.Email, "password")
+	views.RedirectAlert(w, r, "/account/settings", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Your password has been changed and your other devices have been logged out.",
+	})
+}
+
+// notifyChange emails the address that what was changed on the
+// account, in case it was not its owner.
+func (u *Users) notifyChange(toEmail, what string) {
+	go func() {
+		if err := u.emailer.AccountChanged(toEmail, what); err != nil {
+			log.Println(err)
+		}
+	}()
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+func NewTrash(ts models.TrashService, gs models.GalleryService) *Trash {
+	return &Trash{
+		TrashView: views.NewView("bootstrap", "galleries/trash"),
+		ts:        ts,
+		gs:        gs,
+	}
+}
+
+// Trash lists the galleries and images the current user deleted, so
+// they can restore them until they are purged.
+type Trash struct {
+	TrashView *views.View
+	ts        models.TrashService
+	gs        models.GalleryService
+}
+
+// TrashPage is the data of the trash page.
+type TrashPage struct {
+	Galleries []TrashedGallery
+	Images    []TrashedImage
+	// RetentionDays is how many days things stay in the trash.
+	RetentionDays int
+}
+
+// TrashedGallery is a deleted gallery with the time it is purged.
+type TrashedGallery struct {
+	models.Gallery
+	PurgeAt time.Time
+}
+
+// TrashedImage is a deleted image with the time it is purged and
+// the title of its gallery.
+type TrashedImage struct {
+	models.Image
+	GalleryTitle string
+	PurgeAt      time.Time
+}
+
+// Index lists the galleries and images in the trash of the current
+// user.
+//
+// GET /trash
+func (t *Trash) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := t.ts.Galleries(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	images, err := t.ts.Images(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	owned, err := t.gs.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	titles := make(map[uint]string, len(owned))
+	for _, g := range owned {
+		titles[g.ID] = g.Title
+	}
+
+	retention := t.ts.Retention()
+	page := TrashPage{RetentionDays: int(retention / (24 * time.Hour))}
+	for _, g := range galleries {
+		page.Galleries = append(page.Galleries, TrashedGallery{
+			Gallery: g,
+			PurgeAt: g.DeletedAt.Time.Add(retention),
+		})
+	}
+	for _, img := range images {
+		page.Images = append(page.Images, TrashedImage{
+			Image:        img,
+			GalleryTitle: titles[img.GalleryID],
+			PurgeAt:      img.DeletedAt.Time.Add(retention),
+		})
+	}
+	var vd views.Data
+	vd.Yield = page
+	t.TrashView.Render(w, r, vd)
+}
+
+// RestoreGallery takes a gallery of the current user out of the
+// trash.
+//
+// POST /trash/galleries/:id/restore
+func (t *Trash) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	t.restore(w, r, "Gallery", t.ts.RestoreGallery)
+}
+
+// RestoreImage takes an image deleted from a gallery of the current
+// user out of the trash.
+//
+// POST /trash/images/:id/restore
+func (t *Trash) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	t.restore(w, r, "Image", t.ts.RestoreImage)
+}
+
+func (t *Trash) restore(w http.ResponseWriter, r *http.Request, what string, restore func(userID, id uint) error) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, what+" not found", http.StatusNotFound)
+		return
+	}
+	err = restore(user.ID, uint(id))
+	switch err {
+	case nil:
+		views.RedirectAlert(w, r, "/trash", http.StatusFound, views.Alert{
+			Level:   views.AlertLvSuccess,
+			Message: what + " restored.",
+		})
+	case models.ErrNotFound:
+		http.Error(w, what+" not found", http.StatusNotFound)
+	default:
+		log.Println(err)
+		views.RedirectAlert(w, r, "/trash", http.StatusFound, views.Alert{
+			Level:   views.AlertLvError,
+			Message: views.AlertMsgGeneric,
+		})
+	}
+}
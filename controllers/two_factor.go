@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/middleware"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/totp"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+// totpIssuer is the name authenticator apps show for our codes.
+const totpIssuer = "Goweb.learn"
+
+// TwoFactorForm is used to process every form asking for an
+// authentication code, from the app or a recovery code.
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+// TwoFactorPage is the data of the two-factor settings page.
+// RecoveryCodes is only set right after they were generated, since
+// it is the only time we can show them.
+type TwoFactorPage struct {
+	Enabled       bool
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+	CodesLeft     int
+}
+
+// startSecondFactor will create a pending session for a user whose
+// password was verified, so they can enter their second factor.
+func (u *Users) startSecondFactor(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		IP:        middleware.RemoteIP(r),
+		UserAgent: r.UserAgent(),
+		Pending:   true,
+	}
+	if err := u.ss.Create(&session); err != nil {
+		return err
+	}
+	u.cookie.SetPending(w, &session)
+	return nil
+}
+
+// pendingUser will look up the pending session from the cookie. If
+// there is none the user is sent back to the login page.
+func (u *Users) pendingUser(w http.ResponseWriter, r *http.Request) (*models.User, *models.Session, bool) {
+	cookie, err := r.Cookie(middleware.PendingCookieName)
+	if err == nil {
+		var user *models.User
+		var session *models.Session
+		user, session, err = u.ss.Pending(cookie.Value)
+		if err == nil {
+			return user, session, true
+		}
+	}
+	if err != nil && err != http.ErrNoCookie && err != models.ErrNotFound {
+		log.Println(err)
+	}
+	u.cookie.ClearPending(w)
+	views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+		Level:   views.AlertLvWarning,
+		Message: "Your login has expired. Please log in again.",
+	})
+	return nil, nil, false
+}
+
+// GetLoginTwoFactor renders the form asking for the second factor
+// after the password.
+//
+// GET /login/2fa
+func (u *Users) GetLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := u.pendingUser(w, r); !ok {
+		return
+	}
+	u.TwoFactorLoginView.Render(w, r, nil)
+}
+
+// PostLoginTwoFactor verifies the second factor and logs the user
+// in.
+//
+// POST /login/2fa
+func (u *Users) PostLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, session, ok := u.pendingUser(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if err := u.tfs.Verify(user, form.Code); err != nil {
+		if err == models.ErrCodeInvalid {
+			if err := u.ss.PendingFailed(session); err != nil {
+				log.Println(err)
+			}
+		}
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	_ = u.ss.Delete(session.ID)
+	u.cookie.ClearPending(w)
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if len(form.Code) == totp.Digits {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	left, err := u.tfs.RecoveryCodesLeft(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/account/2fa", http.StatusFound, views.Alert{
+		Level:   views.AlertLvWarning,
+		Message: fmt.Sprintf("You logged in with a recovery code. You have %d left.", left),
+	})
+}
+
+// TwoFactor displays the two-factor authentication settings.
+//
+// GET /account/2fa
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	u.renderTwoFactor(w, r, vd, nil)
+}
+
+// EnrollTwoFactor generates the secret for the authenticator app
+// of the user and shows it, along with the form to confirm it.
+//
+// POST /account/2fa/enroll
+func (u *Users) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	if err := u.tfs.Enroll(user); err != nil {
+		vd.SetAlert(err)
+	}
+	u.renderTwoFactor(w, r, vd, nil)
+}
+
+// EnableTwoFactor checks a code from the authenticator app and
+// turns two-factor authentication on.
+//
+// POST /account/2fa/enable
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+	codes, err := u.tfs.Enable(user, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Two-factor authentication is on. Save your recovery codes now, you will not be able to see them again.",
+	}
+	u.renderTwoFactor(w, r, vd, codes)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user.
+//
+// POST /account/2fa/recovery-codes
+func (u *Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+	codes, err := u.tfs.RegenerateRecoveryCodes(user, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Your old recovery codes no longer work. Save the new ones now, you will not be able to see them again.",
+	}
+	u.renderTwoFactor(w, r, vd, codes)
+}
+
+// DisableTwoFactor turns two-factor authentication off.
+//
+// POST /account/2fa/disable
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+	if err := u.tfs.Disable(user, form.Code); err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/2fa", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Two-factor authentication is off.",
+	})
+}
+
+// renderTwoFactor will render the two-factor settings page for the
+// current user.
+func (u *Users) renderTwoFactor(w http.ResponseWriter, r *http.Request, vd views.Data, codes []string) {
+	user := context.User(r.Context())
+	page := TwoFactorPage{
+		Enabled:       user.TOTPEnabled,
+		RecoveryCodes: codes,
+	}
+	if user.TOTPEnabled {
+		left, err := u.tfs.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		page.CodesLeft = left
+	} else if user.TOTPSecret != "" {
+		page.Secret = user.TOTPSecret
+		page.URI = totp.URI(totpIssuer, user.Email, user.TOTPSecret)
+	}
+	vd.Yield = page
+	u.TwoFactorView.Render(w, r, vd)
+}
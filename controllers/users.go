@@ -4,33 +4,63 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"time"
+	"strconv"
 
+	"github.com/gorilla/mux"
 	"github.com/monkjunior/goweb.learn/context"
 	"github.com/monkjunior/goweb.learn/email"
+	"github.com/monkjunior/goweb.learn/middleware"
 	"github.com/monkjunior/goweb.learn/models"
-	"github.com/monkjunior/goweb.learn/rand"
+	"github.com/monkjunior/goweb.learn/oidc"
 	"github.com/monkjunior/goweb.learn/views"
 )
 
-func NewUsers(us models.UserService, emailer *email.Client) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, ats models.APITokenService,
+	tfs models.TwoFactorService, emailer *email.Client, cookie middleware.SessionCookie,
+	limits LoginLimits, providers []*oidc.Provider) *Users {
 	return &Users{
-		NewView:      views.NewView("bootstrap", "users/new"),
-		LoginView:    views.NewView("bootstrap", "users/login"),
-		ForgotPwView: views.NewView("bootstrap", "users/forgot_pw"),
-		ResetPwView:  views.NewView("bootstrap", "users/reset_pw"),
-		us:           us,
-		emailer:      emailer,
+		NewView:            views.NewView("bootstrap", "users/new"),
+		LoginView:          views.NewView("bootstrap", "users/login"),
+		ForgotPwView:       views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:        views.NewView("bootstrap", "users/reset_pw"),
+		AccountView:        views.NewView("bootstrap", "users/account"),
+		SessionsView:       views.NewView("bootstrap", "users/sessions"),
+		TwoFactorView:      views.NewView("bootstrap", "users/two_factor"),
+		TwoFactorLoginView: views.NewView("bootstrap", "users/two_factor_login"),
+		MagicLinkView:      views.NewView("bootstrap", "users/magic_link"),
+		MagicLoginView:     views.NewView("bootstrap", "users/magic_login"),
+		SettingsView:       views.NewView("bootstrap", "users/settings"),
+		us:                 us,
+		ss:                 ss,
+		ats:                ats,
+		tfs:                tfs,
+		emailer:            emailer,
+		cookie:             cookie,
+		limits:             limits,
+		providers:          providers,
 	}
 }
 
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPwView *views.View
-	ResetPwView  *views.View
-	us           models.UserService
-	emailer      *email.Client
+	NewView            *views.View
+	LoginView          *views.View
+	ForgotPwView       *views.View
+	ResetPwView        *views.View
+	AccountView        *views.View
+	SessionsView       *views.View
+	TwoFactorView      *views.View
+	TwoFactorLoginView *views.View
+	MagicLinkView      *views.View
+	MagicLoginView     *views.View
+	SettingsView       *views.View
+	us                 models.UserService
+	ss                 models.SessionService
+	ats                models.APITokenService
+	tfs                models.TwoFactorService
+	emailer            *email.Client
+	cookie             middleware.SessionCookie
+	limits             LoginLimits
+	providers          []*oidc.Provider
 }
 
 // New is used to render the form where a user can create
@@ -77,7 +107,10 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Println(err)
 	}
-	err = u.signIn(w, &user)
+	if err := u.sendVerification(&user); err != nil {
+		log.Println(err)
+	}
+	err = u.signIn(w, r, &user)
 	if err != nil {
 		log.Println(err)
 		http.Redirect(w, r, "/login", http.StatusFound)
@@ -85,7 +118,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	alert := views.Alert{
 		Level:   views.AlertLvSuccess,
-		Message: "Welcome to Goweb.com",
+		Message: "Welcome to Goweb.com! We sent you an email to verify your address.",
 	}
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
 }
@@ -100,7 +133,19 @@ type LoginForm struct {
 //
 // GET /login
 func (u *Users) GetLogin(w http.ResponseWriter, r *http.Request) {
-	u.LoginView.Render(w, r, nil)
+	u.renderLogin(w, r, views.Data{})
+}
+
+// LoginPage is the data of the login page, which has a button for
+// each identity provider.
+type LoginPage struct {
+	Providers []*oidc.Provider
+}
+
+// renderLogin will render the login page.
+func (u *Users) renderLogin(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	vd.Yield = LoginPage{Providers: u.providers}
+	u.LoginView.Render(w, r, vd)
 }
 
 // PostLogin is used to process login form when a user tries to
@@ -112,74 +157,73 @@ func (u *Users) PostLogin(w http.ResponseWriter, r *http.Request) {
 	var form LoginForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	if err := u.checkLogin(r, form.Email); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
 		return
 	}
 
 	user, err := u.us.Authenticate(form.Email, form.Password)
 
 	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			vd.AlertError("Invalid email address")
-		default:
+		if err == models.ErrCredentialsInvalid {
+			u.loginFailed(r, form.Email)
+		}
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+	u.loginSucceeded(r, form.Email)
+
+	if user.TOTPEnabled {
+		if err := u.startSecondFactor(w, r, user); err != nil {
 			vd.SetAlert(err)
+			u.renderLogin(w, r, vd)
+			return
 		}
-		u.LoginView.Render(w, r, vd)
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
 		return
 	}
 
-	err = u.signIn(w, user)
+	err = u.signIn(w, r, user)
 	if err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
+		return
 	}
 
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
-// signIn is used to sign the given user in via cookie
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return nil
-		}
+// signIn is used to sign the given user in via cookie. It starts
+// a new session, so the other devices of the user stay logged in.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		IP:        middleware.RemoteIP(r),
+		UserAgent: r.UserAgent(),
 	}
-
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
-		HttpOnly: true,
+	if err := u.ss.Create(&session); err != nil {
+		return err
 	}
-	http.SetCookie(w, &cookie)
+	u.cookie.Set(w, &session)
 	return nil
 }
 
 // Logout is used to delete the user's cookies (remember_token)
-// and then will update the user resource with a new remember_token
+// and then will delete the session of this device
 //
 // POST /logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	// Invalidate the user's cookie
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
-	// Change remember_token
-	user := context.User(r.Context())
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	_ = u.us.Update(user)
+	u.cookie.Clear(w)
+	if session := context.Session(r.Context()); session != nil {
+		_ = u.ss.Delete(session.ID)
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -201,22 +245,32 @@ func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 		u.ForgotPwView.Render(w, r, vd)
 		return
 	}
-	token, err := u.us.InitiateReset(form.Email)
-	if err != nil {
+	if err := u.checkReset(r, form.Email); err != nil {
 		vd.SetAlert(err)
 		u.ForgotPwView.Render(w, r, vd)
 		return
 	}
-	err = u.emailer.ResetPw(form.Email, token)
-	if err != nil {
+	// Whether there is an account with the email or not, the
+	// response is the same so nobody can find out.
+	token, err := u.us.InitiateReset(form.Email)
+	switch err {
+	case nil:
+		// Sending the email takes long enough to tell known
+		// addresses apart, so it is not waited for.
+		go func(email string) {
+			if err := u.emailer.ResetPw(email, token); err != nil {
+				log.Println(err)
+			}
+		}(form.Email)
+	case models.ErrNotFound:
+	default:
 		vd.SetAlert(err)
 		u.ForgotPwView.Render(w, r, vd)
 		return
 	}
-	_ = token
 	views.RedirectAlert(w, r, "/reset", http.StatusFound, views.Alert{
 		Level:   views.AlertLvSuccess,
-		Message: "Instructions for resetting your password have been emailed to you.",
+		Message: "If there is an account with this email address, we have emailed it instructions for resetting the password.",
 	})
 }
 
@@ -253,21 +307,261 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		u.ResetPwView.Render(w, r, vd)
 		return
 	}
-	u.signIn(w, user)
+	// A new password is a good reason to unlock the account.
+	u.loginSucceeded(r, user.Email)
+	// Whoever knew the old password may still be logged in.
+	if err := u.ss.DeleteByUserID(user.ID, 0); err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+	// The reset email alone is not enough to get past two-factor
+	// authentication, users still need their app or a recovery code.
+	if user.TOTPEnabled {
+		if err := u.startSecondFactor(w, r, user); err != nil {
+			vd.SetAlert(err)
+			u.ResetPwView.Render(w, r, vd)
+			return
+		}
+		views.RedirectAlert(w, r, "/login/2fa", http.StatusFound, views.Alert{
+			Level:   views.AlertLvSuccess,
+			Message: "Your password has been reset. Enter your authentication code to log in.",
+		})
+		return
+	}
+	u.signIn(w, r, user)
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
 		Level:   views.AlertLvSuccess,
 		Message: "Your password has been reset and you have been logged in!",
 	})
 }
 
+// AccountPage is the data of the account settings page. NewToken
+// is only set right after an API token was created, since it is the
+// only time we can show it.
+type AccountPage struct {
+	User     *models.User
+	Tokens   []models.APIToken
+	NewToken *models.APIToken
+}
+
+// Account displays the account settings of the current user.
+//
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	u.renderAccount(w, r, vd, nil)
+}
+
+// renderAccount will render the account page for the current user.
+func (u *Users) renderAccount(w http.ResponseWriter, r *http.Request, vd views.Data, newToken *models.APIToken) {
+	user := context.User(r.Context())
+	tokens, err := u.ats.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = AccountPage{
+		User:     user,
+		Tokens:   tokens,
+		NewToken: newToken,
+	}
+	u.AccountView.Render(w, r, vd)
+}
+
+// ImagePrivacyForm is used to process the photo privacy form.
+type ImagePrivacyForm struct {
+	KeepMetadata bool `schema:"keep_metadata"`
+}
+
+// UpdateImagePrivacy processes the photo privacy form.
+//
+// POST /account/images
+func (u *Users) UpdateImagePrivacy(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form ImagePrivacyForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd, nil)
+		return
+	}
+	user.KeepImageMetadata = form.KeepMetadata
+	if err := u.us.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd, nil)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Your photo privacy settings have been saved.",
+	})
+}
+
+// SessionsPage is the data of the sessions page.
+type SessionsPage struct {
+	Sessions []models.Session
+	// CurrentID is the ID of the session of this device.
+	CurrentID uint
+}
+
+// Sessions lists the devices the current user is logged in on.
+//
+// GET /account/sessions
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	u.renderSessions(w, r, vd)
+}
+
+func (u *Users) renderSessions(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	page := SessionsPage{Sessions: sessions}
+	if session := context.Session(r.Context()); session != nil {
+		page.CurrentID = session.ID
+	}
+	vd.Yield = page
+	u.SessionsView.Render(w, r, vd)
+}
+
+// RevokeSession logs out one of the devices of the current user.
+//
+// POST /account/sessions/:id/delete
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	session, err := u.ss.ByID(uint(id))
+	if err == nil && session.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+	if err == models.ErrNotFound {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = u.ss.Delete(session.ID)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderSessions(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/sessions", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "The device has been logged out.",
+	})
+}
+
+// RevokeOtherSessions logs out every device of the current user
+// but this one.
+//
+// POST /account/sessions/delete
+func (u *Users) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var keep uint
+	if session := context.Session(r.Context()); session != nil {
+		keep = session.ID
+	}
+	if err := u.ss.DeleteByUserID(user.ID, keep); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderSessions(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/sessions", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "All your other devices have been logged out.",
+	})
+}
+
+// APITokenForm is used to process the new API token form.
+type APITokenForm struct {
+	Name  string `schema:"name"`
+	Scope string `schema:"scope"`
+}
+
+// CreateAPIToken creates a personal API token and shows it to the
+// user, once.
+//
+// POST /account/tokens
+func (u *Users) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form APITokenForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd, nil)
+		return
+	}
+	token := models.APIToken{
+		UserID: user.ID,
+		Name:   form.Name,
+		Scope:  form.Scope,
+	}
+	if err := u.ats.Create(&token); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd, nil)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "Your API token has been created. Copy it now, you will not be able to see it again.",
+	}
+	u.renderAccount(w, r, vd, &token)
+}
+
+// RevokeAPIToken deletes an API token of the current user.
+//
+// POST /account/tokens/:id/delete
+func (u *Users) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	token, err := u.ats.ByID(uint(id))
+	if err == nil && token.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+	if err == models.ErrNotFound {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = u.ats.Delete(token.ID)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd, nil)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvSuccess,
+		Message: "The API token " + token.Name + " has been revoked.",
+	})
+}
+
 // CookieTest is used to display cookies set on the current user
 func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+	cookie, err := r.Cookie(middleware.SessionCookieName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	user, err := u.us.ByRemember(cookie.Value)
+	user, _, err := u.ss.Authenticate(cookie.Value, middleware.RemoteIP(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
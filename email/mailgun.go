@@ -3,6 +3,7 @@ package email
 import (
 	"context"
 	"fmt"
+	"html"
 	"net/url"
 	"time"
 
@@ -12,6 +13,12 @@ import (
 const (
 	// TODO: make this configurable
 	resetBaseURL   = "http://127.0.0.1:8080/reset"
+	forgotURL      = "http://127.0.0.1:8080/forgot"
+	inviteBaseURL  = "http://127.0.0.1:8080/invites/accept"
+	verifyBaseURL  = "http://127.0.0.1:8080/verify"
+	magicBaseURL   = "http://127.0.0.1:8080/login/magic"
+	settingsURL    = "http://127.0.0.1:8080/account/settings"
+	deleteBaseURL  = "http://127.0.0.1:8080/account/delete/confirm"
 	welcomeSubject = "Welcome to Goweb.learn!"
 	welcomeText    = `Hi there!
 
@@ -49,6 +56,163 @@ If you didn't request a password reset you can safely ignore this email and your
 <br/>
 Best,<br/>
 Goweb Learn Support<br/>
+`
+	verifySubject  = "Please verify your email address"
+	verifyTextTmpl = `Hi there!
+
+Please confirm that this is your email address by following the link below:
+%s
+
+This link expires in 48 hours. If you did not sign up for Goweb.learn you can safely ignore this email.
+
+Best,
+Goweb Learn Support
+`
+	verifyHTMLTmpl = `Hi there!<br/>
+<br/>
+Please confirm that this is your email address by following the link below:<br/>
+<a href="%s">%s</a><br/>
+<br/>
+This link expires in 48 hours. If you did not sign up for Goweb.learn you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+Goweb Learn Support<br/>
+`
+	magicSubject  = "Your login link"
+	magicTextTmpl = `Hi there!
+
+Follow the link below to log in to Goweb.learn:
+%s
+
+This link expires in 15 minutes and only works once. If you did not ask for it you can safely ignore this email.
+
+Best,
+Goweb Learn Support
+`
+	magicHTMLTmpl = `Hi there!<br/>
+<br/>
+Follow the link below to log in to Goweb.learn:<br/>
+<a href="%s">%s</a><br/>
+<br/>
+This link expires in 15 minutes and only works once. If you did not ask for it you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+Goweb Learn Support<br/>
+`
+	changedSubjectTmpl = "Your %s was changed"
+	changedTextTmpl    = `Hi there!
+
+The %s of your Goweb.learn account was just changed.
+
+If this was you, there is nothing else to do. If it was not, please reply to this email right away so we can help you recover your account.
+
+Best,
+Goweb Learn Support
+`
+	changedHTMLTmpl = `Hi there!<br/>
+<br/>
+The %s of your Goweb.learn account was just changed.<br/>
+<br/>
+If this was you, there is nothing else to do. If it was not, please reply to this email right away so we can help you recover your account.<br/>
+<br/>
+Best,<br/>
+Goweb Learn Support<br/>
+`
+	deletionSubject  = "Your account will be deleted"
+	deletionTextTmpl = `Hi there!
+
+As you asked, your Goweb.learn account and all your galleries will be deleted for good on %s.
+
+If you change your mind, log in before then and cancel the deletion from your account settings:
+%s
+
+If you did not ask for this, please log in, cancel the deletion and change your password right away.
+
+Best,
+Goweb Learn Support
+`
+	deletionHTMLTmpl = `Hi there!<br/>
+<br/>
+As you asked, your Goweb.learn account and all your galleries will be deleted for good on %s.<br/>
+<br/>
+If you change your mind, log in before then and cancel the deletion from your account settings:<br/>
+<a href="%s">%s</a><br/>
+<br/>
+If you did not ask for this, please log in, cancel the deletion and change your password right away.<br/>
+<br/>
+Best,<br/>
+Goweb Learn Support<br/>
+`
+	confirmDeletionSubject  = "Confirm the deletion of your account"
+	confirmDeletionTextTmpl = `Hi there!
+
+Follow the link below to confirm that your Goweb.learn account and all your galleries should be deleted:
+%s
+
+This link expires in an hour and only works once. If you did not ask for it you can safely ignore this email.
+
+Best,
+Goweb Learn Support
+`
+	confirmDeletionHTMLTmpl = `Hi there!<br/>
+<br/>
+Follow the link below to confirm that your Goweb.learn account and all your galleries should be deleted:<br/>
+<a href="%s">%s</a><br/>
+<br/>
+This link expires in an hour and only works once. If you did not ask for it you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+Goweb Learn Support<br/>
+`
+	lockedSubject  = "Your account has been locked"
+	lockedTextTmpl = `Hi there!
+
+Someone entered the wrong password for your account too many times, so we locked it for %d minutes.
+
+If this was you, you can log in again after that. If it was not, we recommend you reset your password:
+%s
+
+Resetting your password also unlocks your account.
+
+Best,
+Goweb Learn Support
+`
+	lockedHTMLTmpl = `Hi there!<br/>
+<br/>
+Someone entered the wrong password for your account too many times, so we locked it for %d minutes.<br/>
+<br/>
+If this was you, you can log in again after that. If it was not, we recommend you reset your password:<br/>
+<a href="%s">%s</a><br/>
+<br/>
+Resetting your password also unlocks your account.<br/>
+<br/>
+Best,<br/>
+Goweb Learn Support<br/>
+`
+	inviteSubjectTmpl = "%s invited you to a gallery on Goweb.learn"
+	inviteTextTmpl    = `Hi there!
+
+%s has invited you to join the gallery "%s" as %s.
+
+To accept, log in or sign up with this email address and follow the link below:
+%s
+
+This invitation expires in 7 days. If you were not expecting it you can safely ignore this email.
+
+Best,
+Goweb Learn Support
+`
+	inviteHTMLTmpl = `Hi there!<br/>
+<br/>
+%s has invited you to join the gallery "%s" as %s.<br/>
+<br/>
+To accept, log in or sign up with this email address and follow the link below:<br/>
+<a href="%s">%s</a><br/>
+<br/>
+This invitation expires in 7 days. If you were not expecting it you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+Goweb Learn Support<br/>
 `
 )
 
@@ -110,6 +274,125 @@ func (c *Client) ResetPw(toEmail, token string) error {
 	return err
 }
 
+func (c *Client) InviteToGallery(toEmail, fromName, galleryTitle, role, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	inviteUrl := inviteBaseURL + "?" + v.Encode()
+	subject := fmt.Sprintf(inviteSubjectTmpl, fromName)
+	inviteText := fmt.Sprintf(inviteTextTmpl, fromName, galleryTitle, role, inviteUrl)
+
+	message := c.mg.NewMessage(c.sender, subject, inviteText, toEmail)
+	inviteHTML := fmt.Sprintf(inviteHTMLTmpl, html.EscapeString(fromName),
+		html.EscapeString(galleryTitle), role, inviteUrl, inviteUrl)
+	message.SetHtml(inviteHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+func (c *Client) VerifyEmail(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	verifyUrl := verifyBaseURL + "?" + v.Encode()
+	verifyText := fmt.Sprintf(verifyTextTmpl, verifyUrl)
+
+	message := c.mg.NewMessage(c.sender, verifySubject, verifyText, toEmail)
+	verifyHTML := fmt.Sprintf(verifyHTMLTmpl, verifyUrl, verifyUrl)
+	message.SetHtml(verifyHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+func (c *Client) MagicLink(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	magicUrl := magicBaseURL + "?" + v.Encode()
+	magicText := fmt.Sprintf(magicTextTmpl, magicUrl)
+
+	message := c.mg.NewMessage(c.sender, magicSubject, magicText, toEmail)
+	magicHTML := fmt.Sprintf(magicHTMLTmpl, magicUrl, magicUrl)
+	message.SetHtml(magicHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+// AccountChanged lets users know that what, eg: "password", was
+// changed on their account. Email changes are sent to the old
+// address.
+func (c *Client) AccountChanged(toEmail, what string) error {
+	subject := fmt.Sprintf(changedSubjectTmpl, what)
+	changedText := fmt.Sprintf(changedTextTmpl, what)
+
+	message := c.mg.NewMessage(c.sender, subject, changedText, toEmail)
+	changedHTML := fmt.Sprintf(changedHTMLTmpl, html.EscapeString(what))
+	message.SetHtml(changedHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+// ConfirmAccountDeletion sends users without a password the link
+// confirming they want their account deleted.
+func (c *Client) ConfirmAccountDeletion(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	deleteUrl := deleteBaseURL + "?" + v.Encode()
+	confirmText := fmt.Sprintf(confirmDeletionTextTmpl, deleteUrl)
+
+	message := c.mg.NewMessage(c.sender, confirmDeletionSubject, confirmText, toEmail)
+	confirmHTML := fmt.Sprintf(confirmDeletionHTMLTmpl, deleteUrl, deleteUrl)
+	message.SetHtml(confirmHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+func (c *Client) AccountDeletionScheduled(toEmail string, deleteAt time.Time) error {
+	date := deleteAt.Format("January 2, 2006")
+	deletionText := fmt.Sprintf(deletionTextTmpl, date, settingsURL)
+
+	message := c.mg.NewMessage(c.sender, deletionSubject, deletionText, toEmail)
+	deletionHTML := fmt.Sprintf(deletionHTMLTmpl, date, settingsURL, settingsURL)
+	message.SetHtml(deletionHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+func (c *Client) AccountLocked(toEmail string, lockedFor time.Duration) error {
+	lockedText := fmt.Sprintf(lockedTextTmpl, int(lockedFor.Minutes()), forgotURL)
+
+	message := c.mg.NewMessage(c.sender, lockedSubject, lockedText, toEmail)
+	lockedHTML := fmt.Sprintf(lockedHTMLTmpl, int(lockedFor.Minutes()), forgotURL, forgotURL)
+	message.SetHtml(lockedHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
 func buildEmail(name, email string) string {
 	if name == "" {
 		return email
@@ -0,0 +1,342 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotJPEG is returned when the data does not start with a
+	// JPEG start of image marker.
+	ErrNotJPEG = errors.New("exif: data is not a JPEG image")
+	// ErrNoExif is returned when the JPEG does not contain an
+	// Exif segment.
+	ErrNoExif = errors.New("exif: no exif data found")
+	// ErrInvalid is returned when the Exif segment is malformed.
+	ErrInvalid = errors.New("exif: invalid exif data")
+)
+
+const (
+	markerSOI  = 0xD8
+	markerSOS  = 0xDA
+	markerEOI  = 0xD9
+	markerAPP1 = 0xE1
+	// APP13 holds Photoshop IRB data, which may contain IPTC
+	// location fields.
+	markerAPP13 = 0xED
+
+	tagOrientation      = 0x0112
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagLensMake         = 0xA433
+	tagLensModel        = 0xA434
+
+	typeASCII = 2
+	typeShort = 3
+	typeLong  = 4
+
+	dateTimeLayout = "2006:01:02 15:04:05"
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// Metadata holds the Exif fields we care about.
+type Metadata struct {
+	// Orientation is the Exif orientation tag, from 1 to 8. It
+	// is 1 when the image does not need to be transformed.
+	Orientation int
+	Make        string
+	Model       string
+	LensMake    string
+	LensModel   string
+	// DateTimeOriginal is when the photo was taken, or the zero
+	// time if unknown. Exif does not store a time zone, so it is
+	// returned as UTC.
+	DateTimeOriginal time.Time
+	// HasGPS reports whether the image contains GPS data.
+	HasGPS bool
+}
+
+// segment is a JPEG marker segment found before the image data.
+type segment struct {
+	marker byte
+	// start and end are the offsets of the whole segment, from
+	// the 0xFF of its marker to the end of its payload.
+	start, end int
+}
+
+func (s segment) payload(data []byte) []byte {
+	return data[s.start+4 : s.end]
+}
+
+// segments will list the marker segments of a JPEG up to the
+// start of the scan, where the image data begins.
+func segments(data []byte) ([]segment, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, ErrNotJPEG
+	}
+	var ret []segment
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, ErrInvalid
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			// Fill byte before the marker.
+			i++
+			continue
+		}
+		if marker == markerSOS || marker == markerEOI {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, ErrInvalid
+		}
+		ret = append(ret, segment{marker: marker, start: i, end: i + 2 + length})
+		i += 2 + length
+	}
+	return ret, nil
+}
+
+// Parse will read the Exif metadata of a JPEG image.
+func Parse(data []byte) (*Metadata, error) {
+	segs, err := segments(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range segs {
+		p := s.payload(data)
+		if s.marker == markerAPP1 && bytes.HasPrefix(p, exifHeader) {
+			return parseTIFF(p[len(exifHeader):])
+		}
+	}
+	return nil, ErrNoExif
+}
+
+// Strip will remove every segment that may contain private data,
+// such as the GPS location or the camera serial number, from a
+// JPEG image: Exif and XMP (APP1) and Photoshop (APP13) segments.
+func Strip(data []byte) ([]byte, error) {
+	segs, err := segments(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 0, len(data))
+	prev := 0
+	for _, s := range segs {
+		if s.marker != markerAPP1 && s.marker != markerAPP13 {
+			continue
+		}
+		ret = append(ret, data[prev:s.start]...)
+		prev = s.end
+	}
+	return append(ret, data[prev:]...), nil
+}
+
+// CopyMetadata will copy the Exif, XMP and Photoshop segments of
+// src into the JPEG image dst, setting the orientation to 1. It is
+// used to keep the metadata of an image that was re-encoded after
+// being rotated.
+func CopyMetadata(dst, src []byte) ([]byte, error) {
+	srcSegs, err := segments(src)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := segments(dst); err != nil {
+		return nil, err
+	}
+	var meta []byte
+	for _, s := range srcSegs {
+		if s.marker != markerAPP1 && s.marker != markerAPP13 {
+			continue
+		}
+		seg := append([]byte(nil), src[s.start:s.end]...)
+		p := seg[4:]
+		if s.marker == markerAPP1 && bytes.HasPrefix(p, exifHeader) {
+			resetOrientation(p[len(exifHeader):])
+		}
+		meta = append(meta, seg...)
+	}
+	ret := make([]byte, 0, len(dst)+len(meta))
+	ret = append(ret, dst[:2]...)
+	ret = append(ret, meta...)
+	return append(ret, dst[2:]...), nil
+}
+
+// tiff is the TIFF structure Exif data is stored in.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// entry is a single IFD entry. offset is where its value is
+// stored in the TIFF data.
+type entry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	offset int
+}
+
+func newTIFF(data []byte) (*tiff, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, ErrInvalid
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, ErrInvalid
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil, 0, ErrInvalid
+	}
+	return &tiff{data: data, order: order}, order.Uint32(data[4:]), nil
+}
+
+// ifd will read the entries of the IFD found at offset.
+func (t *tiff) ifd(offset uint32) ([]entry, error) {
+	if int(offset)+2 > len(t.data) {
+		return nil, ErrInvalid
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+	if start+n*12 > len(t.data) {
+		return nil, ErrInvalid
+	}
+	ret := make([]entry, 0, n)
+	for i := 0; i < n; i++ {
+		e := t.data[start+i*12:]
+		ent := entry{
+			tag:   t.order.Uint16(e),
+			typ:   t.order.Uint16(e[2:]),
+			count: t.order.Uint32(e[4:]),
+		}
+		size := typeSize(ent.typ) * int(ent.count)
+		if size <= 4 {
+			// Small values are stored in the entry itself.
+			ent.offset = start + i*12 + 8
+		} else {
+			ent.offset = int(t.order.Uint32(e[8:]))
+		}
+		if size < 0 || ent.offset+size > len(t.data) {
+			continue
+		}
+		ret = append(ret, ent)
+	}
+	return ret, nil
+}
+
+func (t *tiff) uint(e entry) (uint32, bool) {
+	if e.count < 1 {
+		return 0, false
+	}
+	switch e.typ {
+	case typeShort:
+		return uint32(t.order.Uint16(t.data[e.offset:])), true
+	case typeLong:
+		return t.order.Uint32(t.data[e.offset:]), true
+	}
+	return 0, false
+}
+
+func (t *tiff) string(e entry) string {
+	if e.typ != typeASCII {
+		return ""
+	}
+	s := string(t.data[e.offset : e.offset+int(e.count)])
+	s = strings.TrimRight(s, "\x00 ")
+	return strings.TrimSpace(s)
+}
+
+func parseTIFF(data []byte) (*Metadata, error) {
+	t, ifd0, err := newTIFF(data)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := t.ifd(ifd0)
+	if err != nil {
+		return nil, err
+	}
+	md := Metadata{Orientation: 1}
+	for _, e := range entries {
+		switch e.tag {
+		case tagOrientation:
+			if o, ok := t.uint(e); ok && o >= 1 && o <= 8 {
+				md.Orientation = int(o)
+			}
+		case tagMake:
+			md.Make = t.string(e)
+		case tagModel:
+			md.Model = t.string(e)
+		case tagGPSIFD:
+			md.HasGPS = true
+		case tagExifIFD:
+			offset, ok := t.uint(e)
+			if !ok {
+				continue
+			}
+			sub, err := t.ifd(offset)
+			if err != nil {
+				continue
+			}
+			for _, se := range sub {
+				switch se.tag {
+				case tagDateTimeOriginal:
+					if dt, err := time.Parse(dateTimeLayout, t.string(se)); err == nil {
+						md.DateTimeOriginal = dt
+					}
+				case tagLensMake:
+					md.LensMake = t.string(se)
+				case tagLensModel:
+					md.LensModel = t.string(se)
+				}
+			}
+		}
+	}
+	return &md, nil
+}
+
+// resetOrientation will set the orientation tag of the TIFF data
+// to 1, in place.
+func resetOrientation(data []byte) {
+	t, ifd0, err := newTIFF(data)
+	if err != nil {
+		return
+	}
+	entries, err := t.ifd(ifd0)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.tag != tagOrientation || e.typ != typeShort || e.count < 1 {
+			continue
+		}
+		t.order.PutUint16(t.data[e.offset:], 1)
+	}
+}
+
+func typeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12:
+		return 8
+	}
+	return -1
+}
@@ -0,0 +1,51 @@
+package exif
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Orient will transform img according to the Exif orientation
+// tag, so that it displays upright without any metadata. Images
+// with orientation 1 or an unknown orientation are returned as is.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Orientations 5 to 8 swap the width and height.
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // Rotated 180
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // Mirrored vertically
+				sx, sy = dx, h-1-dy
+			case 5: // Transposed
+				sx, sy = dy, dx
+			case 6: // Rotated 90 clockwise to display
+				sx, sy = dy, h-1-dx
+			case 7: // Transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // Rotated 90 counter clockwise to display
+				sx, sy = w-1-dy, dx
+			}
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
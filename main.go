@@ -7,25 +7,47 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/api"
 	"github.com/monkjunior/goweb.learn/controllers"
 	"github.com/monkjunior/goweb.learn/email"
 	"github.com/monkjunior/goweb.learn/middleware"
 	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/policy"
 	"github.com/monkjunior/goweb.learn/rand"
+	"github.com/monkjunior/goweb.learn/ratelimit"
+	"github.com/monkjunior/goweb.learn/throttle"
 )
 
 func main() {
 	boolPtr := flag.Bool("prod", false, "Set to true in production. This ensures that a .config file is provided before the application start")
+	backfillImages := flag.Bool("backfill-images", false, "Create database records for images already stored on disk, then exit")
 	flag.Parse()
 	cfg := LoadConfig(*boolPtr)
+	store, err := cfg.Storage.Store()
+	if err != nil {
+		panic(err)
+	}
+	hasher, err := cfg.Passwords.Hashing.Hasher(cfg.Pepper)
+	if err != nil {
+		panic(err)
+	}
 	service, err := models.NewServices(
 		models.WithGorm(cfg.Database.ConnectionInfo()),
-		models.WithUser(cfg.HMACKey, cfg.Pepper),
+		models.WithUser(cfg.HMACKey, hasher, cfg.Passwords.Policy()),
 		models.WithGallery(),
-		models.WithImage(),
+		models.WithImage(store),
+		models.WithMember(cfg.HMACKey),
+		models.WithAPIToken(cfg.HMACKey),
+		models.WithSession(cfg.HMACKey, cfg.Sessions.Lifetime()),
+		models.WithTwoFactor(cfg.HMACKey),
+		models.WithIdentity(),
+		models.WithAccount(store),
+		models.WithTrash(store, cfg.Trash.Retention()),
 	)
 	if err != nil {
 		panic(err)
@@ -37,18 +59,38 @@ func main() {
 		panic(err)
 	}
 
+	if *backfillImages {
+		n, err := service.Image.Backfill()
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Backfilled %d image records\n", n)
+		return
+	}
+
 	mailgunCfg := cfg.Mailgun
 	emailer := email.NewClient(
 		email.WithSender("Goweb.learn support", "support@"+mailgunCfg.Domain),
 		email.WithMailgun(mailgunCfg.Domain, mailgunCfg.ApiKey),
 	)
-	_ = emailer
+
+	providers, err := Providers(cfg.OIDC)
+	if err != nil {
+		panic(err)
+	}
 
 	r := mux.NewRouter()
 
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(service.User, emailer)
-	galleriesC := controllers.NewGalleries(service.Gallery, service.Image, *r)
+	sessionCookie := middleware.SessionCookie{Secure: cfg.IsProd()}
+	usersC := controllers.NewUsers(service.User, service.Session, service.APIToken, service.TwoFactor, emailer, sessionCookie,
+		controllers.DefaultLoginLimits(throttle.NewMemoryStore()), providers)
+	identitiesC := controllers.NewIdentities(usersC, service.Identity, providers)
+	accountsC := controllers.NewAccounts(usersC, service.Account)
+	galleryPolicy := policy.New(service.Gallery, service.Member, cfg.Verification.Restricted()...)
+	galleriesC := controllers.NewGalleries(service.Gallery, service.Image, service.Member, service.User, galleryPolicy, emailer, *r)
+	imagesC := controllers.NewImages(service.Image, galleryPolicy)
+	trashC := controllers.NewTrash(service.Trash, service.Gallery)
 
 	authKey, err := rand.Bytes(32)
 	if err != nil {
@@ -57,9 +99,22 @@ func main() {
 
 	csrfMw := csrf.Protect(authKey, csrf.Secure(cfg.IsProd()))
 	userMw := middleware.User{
-		UserService: service.User,
+		SessionService: service.Session,
+		Cookie:         sessionCookie,
+	}
+	tokenMw := api.TokenAuth{
+		APITokenService: service.APIToken,
 	}
 	requireUserMw := middleware.RequireUser{User: userMw}
+	rateStore := ratelimit.NewMemoryStore()
+	rateLimitMw := newRateLimit(rateStore, "default", cfg.RateLimits.Default, nil)
+	staticRateLimitMw := newRateLimit(rateStore, "static", cfg.RateLimits.Static, nil)
+	apiRateLimitMw := newRateLimit(rateStore, "api", cfg.RateLimits.API, api.RateLimited)
+	uploadRateLimitMw := newRateLimit(rateStore, "upload", cfg.RateLimits.Upload, nil)
+	apiUploadRateLimitMw := newRateLimit(rateStore, "upload", cfg.RateLimits.Upload, api.RateLimited)
+	galleryMw := middleware.Gallery{
+		Policy: galleryPolicy,
+	}
 
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", requireUserMw.Apply(staticC.Contact)).Methods("GET")
@@ -67,34 +122,170 @@ func main() {
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
 	r.HandleFunc("/login", usersC.GetLogin).Methods("GET")
 	r.HandleFunc("/login", usersC.PostLogin).Methods("POST")
+	r.HandleFunc("/login/2fa", usersC.GetLoginTwoFactor).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.PostLoginTwoFactor).Methods("POST")
+	r.Handle("/login/email", usersC.MagicLinkView).Methods("GET")
+	r.HandleFunc("/login/email", usersC.InitiateMagicLink).Methods("POST")
+	r.HandleFunc("/login/magic", usersC.MagicLogin).Methods("GET")
+	r.HandleFunc("/login/magic", usersC.CompleteMagicLink).Methods("POST")
 	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
 	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
 	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
 	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
 	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
 	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/account", requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account/settings", requireUserMw.ApplyFn(usersC.Settings)).Methods("GET")
+	r.HandleFunc("/account/settings/name", requireUserMw.ApplyFn(usersC.UpdateName)).Methods("POST")
+	r.HandleFunc("/account/settings/email", requireUserMw.ApplyFn(usersC.ChangeEmail)).Methods("POST")
+	r.HandleFunc("/account/settings/password", requireUserMw.ApplyFn(usersC.ChangePassword)).Methods("POST")
+	r.HandleFunc("/account/export", requireUserMw.ApplyFn(accountsC.Export)).Methods("GET")
+	r.HandleFunc("/account/delete", requireUserMw.ApplyFn(accountsC.ScheduleDeletion)).Methods("POST")
+	r.HandleFunc("/account/delete/confirm", requireUserMw.ApplyFn(accountsC.ConfirmDeletion)).Methods("GET")
+	r.HandleFunc("/account/delete/confirm", requireUserMw.ApplyFn(accountsC.CompleteDeletion)).Methods("POST")
+	r.HandleFunc("/account/delete/cancel", requireUserMw.ApplyFn(accountsC.CancelDeletion)).Methods("POST")
+	r.HandleFunc("/account/images", requireUserMw.ApplyFn(usersC.UpdateImagePrivacy)).Methods("POST")
+	r.HandleFunc("/account/sessions", requireUserMw.ApplyFn(usersC.Sessions)).Methods("GET")
+	r.HandleFunc("/account/sessions/delete", requireUserMw.ApplyFn(usersC.RevokeOtherSessions)).Methods("POST")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/delete", requireUserMw.ApplyFn(usersC.RevokeSession)).Methods("POST")
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+	r.HandleFunc("/account/verify", requireUserMw.ApplyFn(usersC.ResendVerification)).Methods("POST")
+	r.HandleFunc("/account/2fa", requireUserMw.ApplyFn(usersC.TwoFactor)).Methods("GET")
+	r.HandleFunc("/account/2fa/enroll", requireUserMw.ApplyFn(usersC.EnrollTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/enable", requireUserMw.ApplyFn(usersC.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", requireUserMw.ApplyFn(usersC.DisableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/recovery-codes", requireUserMw.ApplyFn(usersC.RegenerateRecoveryCodes)).Methods("POST")
+	r.HandleFunc("/auth/{provider}", identitiesC.Login).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", identitiesC.Callback).Methods("GET")
+	r.HandleFunc("/account/identities", requireUserMw.ApplyFn(identitiesC.Index)).Methods("GET")
+	r.HandleFunc("/account/identities/{id:[0-9]+}/delete", requireUserMw.ApplyFn(identitiesC.Unlink)).Methods("POST")
+	r.HandleFunc("/account/identities/{provider}", requireUserMw.ApplyFn(identitiesC.Link)).Methods("POST")
+	r.HandleFunc("/account/tokens", requireUserMw.ApplyFn(usersC.CreateAPIToken)).Methods("POST")
+	r.HandleFunc("/account/tokens/{id:[0-9]+}/delete", requireUserMw.ApplyFn(usersC.RevokeAPIToken)).Methods("POST")
 
 	// Assets
 	assetsHandler := http.FileServer(http.Dir("./assets/"))
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", assetsHandler))
 
-	//Image route
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
-
 	//Gallery route
+	galleryRoutes(r, galleriesC, imagesC, trashC, &requireUserMw, &galleryMw, uploadRateLimitMw)
+
+	// API routes
+	apiUsers := api.NewUsers()
+	apiGalleries := api.NewGalleries(service.Gallery, service.Image, service.Member, galleryPolicy)
+	apiImages := api.NewImages(service.Image, galleryPolicy)
+	apiR := r.PathPrefix("/api/v1").Subrouter()
+	apiR.Use(func(next http.Handler) http.Handler {
+		return apiRateLimitMw.Apply(next)
+	})
+	apiRoutes(apiR, apiUsers, apiGalleries, apiImages, apiUploadRateLimitMw)
+
+	// Accounts whose deletion grace period is over are deleted in
+	// the background.
+	runEvery(time.Hour, func() {
+		n, err := service.Account.DeleteScheduled()
+		if err != nil {
+			log.Println(err)
+		}
+		if n > 0 {
+			log.Printf("Deleted %d accounts\n", n)
+		}
+	})
+	// Galleries and images are purged from the trash once their
+	// retention period is over.
+	runEvery(time.Hour, func() {
+		n, err := service.Trash.Purge()
+		if err != nil {
+			log.Println(err)
+		}
+		if n > 0 {
+			log.Printf("Purged %d galleries and images from the trash\n", n)
+		}
+	})
+
+	log.Printf("Starting server on port %v\n", cfg.Port)
+	log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), tokenMw.Apply(csrfMw(userMw.Apply(limitByPath(r, staticRateLimitMw, rateLimitMw))))))
+}
+
+// galleryRoutes registers the pages of galleries and their images,
+// with the policy action each of them needs, the image files and
+// the trash.
+func galleryRoutes(r *mux.Router, galleriesC *controllers.Galleries, imagesC *controllers.Images, trashC *controllers.Trash,
+	requireUserMw *middleware.RequireUser, galleryMw *middleware.Gallery, uploadRateLimitMw *middleware.RateLimit) {
 	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET")
 	r.HandleFunc("/galleries/new", requireUserMw.ApplyFn(galleriesC.New)).Methods("GET")
 	r.HandleFunc("/galleries/new", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}", requireUserMw.ApplyFn(galleriesC.Show)).Methods("GET").Name(controllers.ShowGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.GetUpdate)).Methods("GET").Name(controllers.UpdateGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.PostUpdate)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}", galleryMw.ApplyFn(policy.ActionView, galleriesC.Show)).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/shared/{token}", galleriesC.ShowShared).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionUpload, galleriesC.GetUpdate))).Methods("GET").Name(controllers.UpdateGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionEdit, galleriesC.PostUpdate))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionDelete, galleriesC.Delete))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share/rotate", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionShare, galleriesC.RotateShareToken))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(uploadRateLimitMw.ApplyFn(galleryMw.ApplyFn(policy.ActionUpload, galleriesC.ImageUpload)))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionDeleteImages, galleriesC.ImageDelete))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionManageMembers, galleriesC.Members))).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionManageMembers, galleriesC.InviteMember))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{memberID:[0-9]+}/update", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionManageMembers, galleriesC.UpdateMember))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{memberID:[0-9]+}/delete", requireUserMw.ApplyFn(galleryMw.ApplyFn(policy.ActionManageMembers, galleriesC.RemoveMember))).Methods("POST")
+	r.HandleFunc("/invites/accept", requireUserMw.ApplyFn(galleriesC.GetAcceptInvite)).Methods("GET")
+	r.HandleFunc("/invites/accept", requireUserMw.ApplyFn(galleriesC.AcceptInvite)).Methods("POST")
+	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imagesC))
+	r.HandleFunc("/trash", requireUserMw.ApplyFn(trashC.Index)).Methods("GET")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/restore", requireUserMw.ApplyFn(trashC.RestoreGallery)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/restore", requireUserMw.ApplyFn(trashC.RestoreImage)).Methods("POST")
+}
 
-	log.Printf("Starting server on port %v\n", cfg.Port)
-	log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(userMw.Apply(r))))
+// apiRoutes registers the API routes of the current user, and of
+// galleries and their images, on the /api/v1 subrouter.
+func apiRoutes(apiR *mux.Router, apiUsers *api.Users, apiGalleries *api.Galleries, apiImages *api.Images,
+	apiUploadRateLimitMw *middleware.RateLimit) {
+	apiR.HandleFunc("/me", api.RequireUser(apiUsers.Me)).Methods("GET")
+	apiR.HandleFunc("/galleries", api.RequireUser(apiGalleries.Index)).Methods("GET")
+	apiR.HandleFunc("/galleries", api.RequireUser(apiGalleries.Create)).Methods("POST")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}", apiGalleries.Show).Methods("GET")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}", api.RequireUser(apiGalleries.Update)).Methods("PATCH")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}", api.RequireUser(apiGalleries.Delete)).Methods("DELETE")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}/images", apiImages.Index).Methods("GET")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}/images", api.RequireUser(apiUploadRateLimitMw.ApplyFn(apiImages.Create))).Methods("POST")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}", api.RequireUser(apiImages.Delete)).Methods("DELETE")
+}
+
+// runEvery runs job in the background right away, then every d.
+func runEvery(d time.Duration, job func()) {
+	go func() {
+		for {
+			job()
+			time.Sleep(d)
+		}
+	}()
+}
+
+// limitByPath rate limits the requests for assets and images with
+// static, and every other request with others, so that loading a
+// gallery full of images does not use up the limit of the visitor.
+func limitByPath(next http.Handler, static, others *middleware.RateLimit) http.Handler {
+	staticNext := static.Apply(next)
+	othersNext := others.Apply(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/assets/") || strings.HasPrefix(r.URL.Path, "/images/") {
+			staticNext(w, r)
+			return
+		}
+		othersNext(w, r)
+	})
+}
+
+// newRateLimit returns the middleware limiting a group of routes,
+// which lets every request through when the limit is disabled.
+func newRateLimit(store ratelimit.Store, name string, limit ratelimit.Limit, denied http.HandlerFunc) *middleware.RateLimit {
+	mw := middleware.RateLimit{
+		Name:   name,
+		Denied: denied,
+	}
+	if limit.Enabled() {
+		mw.Limiter = ratelimit.New(store, limit)
+	}
+	return &mw
 }
 
 func LoadConfig(configReq bool) Config {
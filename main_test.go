@@ -0,0 +1,570 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/api"
+	"github.com/monkjunior/goweb.learn/controllers"
+	"github.com/monkjunior/goweb.learn/middleware"
+	"github.com/monkjunior/goweb.learn/models"
+	"github.com/monkjunior/goweb.learn/policy"
+	"github.com/monkjunior/goweb.learn/ratelimit"
+	"github.com/monkjunior/goweb.learn/storage"
+)
+
+// The users of the route tests, by the role they have in the
+// gallery. Anonymous visitors are not logged in.
+const (
+	owner       = "owner"
+	editor      = "editor"
+	contributor = "contributor"
+	viewer      = "viewer"
+	nonMember   = "non-member"
+	anonymous   = "anonymous"
+)
+
+var testRoles = []string{owner, editor, contributor, viewer, nonMember, anonymous}
+
+var testUsers = map[string]uint{
+	owner:       1,
+	editor:      2,
+	contributor: 3,
+	viewer:      4,
+	nonMember:   5,
+}
+
+const (
+	testGalleryID  = 10
+	testMemberID   = 20
+	testShareToken = "share-token"
+	// rotatedShareToken is the share token of the gallery once
+	// it is rotated.
+	rotatedShareToken = "rotated-share-token"
+	testImageID       = 30
+)
+
+// fakeGalleries has the gallery of the tests, unlisted when it is
+// looked up with its share token.
+type fakeGalleries struct {
+	models.GalleryService
+	shareToken string
+}
+
+func testGallery() *models.Gallery {
+	gallery := models.Gallery{
+		Title:      "Holidays",
+		UserID:     testUsers[owner],
+		Visibility: models.VisibilityPrivate,
+	}
+	gallery.ID = testGalleryID
+	return &gallery
+}
+
+func (fg *fakeGalleries) ByID(id uint) (*models.Gallery, error) {
+	if id != testGalleryID {
+		return nil, models.ErrNotFound
+	}
+	return testGallery(), nil
+}
+
+func (fg *fakeGalleries) ByUserID(userID uint) ([]models.Gallery, error) {
+	return nil, nil
+}
+
+func (fg *fakeGalleries) ByIDs(ids []uint) ([]models.Gallery, error) {
+	return nil, nil
+}
+
+func (fg *fakeGalleries) ByShareToken(token string) (*models.Gallery, error) {
+	if token != fg.shareToken {
+		return nil, models.ErrNotFound
+	}
+	gallery := testGallery()
+	gallery.Visibility = models.VisibilityUnlisted
+	gallery.ShareToken = fg.shareToken
+	return gallery, nil
+}
+
+func (fg *fakeGalleries) Create(gallery *models.Gallery) error {
+	gallery.ID = testGalleryID + 1
+	return nil
+}
+
+// Update gives the gallery a new share token when it is cleared,
+// like the gallery validator does.
+func (fg *fakeGalleries) Update(gallery *models.Gallery) error {
+	if gallery.ShareToken == "" {
+		fg.shareToken = rotatedShareToken
+		gallery.ShareToken = fg.shareToken
+	}
+	return nil
+}
+
+func (fg *fakeGalleries) Delete(id uint) error {
+	return nil
+}
+
+type fakeMembers struct {
+	models.MemberService
+}
+
+func (fm *fakeMembers) Role(gallery *models.Gallery, userID uint) (string, error) {
+	switch {
+	case userID == 0:
+		return "", nil
+	case userID == gallery.UserID:
+		return models.RoleOwner, nil
+	case userID == testUsers[editor]:
+		return models.RoleEditor, nil
+	case userID == testUsers[contributor]:
+		return models.RoleContributor, nil
+	case userID == testUsers[viewer]:
+		return models.RoleViewer, nil
+	}
+	return "", nil
+}
+
+func (fm *fakeMembers) ByID(id uint) (*models.Member, error) {
+	if id != testMemberID {
+		return nil, models.ErrNotFound
+	}
+	member := models.Member{
+		GalleryID: testGalleryID,
+		UserID:    testUsers[viewer],
+		Role:      models.RoleViewer,
+	}
+	member.ID = id
+	return &member, nil
+}
+
+func (fm *fakeMembers) ByUserID(userID uint) ([]models.Member, error) {
+	return nil, nil
+}
+
+func (fm *fakeMembers) ByGalleryID(galleryID uint) ([]models.Member, error) {
+	return nil, nil
+}
+
+func (fm *fakeMembers) Invite(galleryID uint, email, role string) (string, error) {
+	return "", models.ErrEmailRequired
+}
+
+func (fm *fakeMembers) InviteByToken(token string) (*models.Invite, error) {
+	return nil, models.ErrNotFound
+}
+
+func (fm *fakeMembers) AcceptInvite(token string, user *models.User) (*models.Member, error) {
+	return nil, models.ErrNotFound
+}
+
+func (fm *fakeMembers) Update(member *models.Member) error {
+	return nil
+}
+
+func (fm *fakeMembers) Delete(id uint) error {
+	return nil
+}
+
+type fakeImages struct {
+	models.ImageService
+}
+
+func (fi *fakeImages) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	return []models.Image{{GalleryID: galleryID, Filename: "photo.jpg"}}, nil
+}
+
+func (fi *fakeImages) ByFilename(galleryID uint, filename string) (*models.Image, error) {
+	return &models.Image{GalleryID: galleryID, Filename: filename}, nil
+}
+
+func (fi *fakeImages) ByVariantFilename(galleryID uint, filename string) (*models.Image, error) {
+	return &models.Image{GalleryID: galleryID, Filename: filename}, nil
+}
+
+func (fi *fakeImages) Open(image *models.Image) (io.ReadCloser, *storage.Object, error) {
+	return ioutil.NopCloser(strings.NewReader("image")), &storage.Object{Key: image.Key(), Size: 5}, nil
+}
+
+func (fi *fakeImages) OpenVariant(image *models.Image, size string) (io.ReadCloser, *storage.Object, error) {
+	return ioutil.NopCloser(strings.NewReader("image")), &storage.Object{Key: image.VariantKey(size), Size: 5}, nil
+}
+
+func (fi *fakeImages) Delete(image *models.Image) error {
+	return nil
+}
+
+// fakeTrash has the gallery and an image of it in the trash of
+// the owner.
+type fakeTrash struct {
+	models.TrashService
+}
+
+func (ft *fakeTrash) Galleries(userID uint) ([]models.Gallery, error) {
+	if userID != testUsers[owner] {
+		return nil, nil
+	}
+	return []models.Gallery{*testGallery()}, nil
+}
+
+func (ft *fakeTrash) Images(userID uint) ([]models.Image, error) {
+	return nil, nil
+}
+
+func (ft *fakeTrash) RestoreGallery(userID, id uint) error {
+	if userID != testUsers[owner] || id != testGalleryID {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+func (ft *fakeTrash) RestoreImage(userID, id uint) error {
+	if userID != testUsers[owner] || id != testImageID {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+func (ft *fakeTrash) Retention() time.Duration {
+	return 30 * 24 * time.Hour
+}
+
+type fakeUsers struct {
+	models.UserService
+}
+
+func (fu *fakeUsers) ByID(id uint) (*models.User, error) {
+	user := models.User{Name: "Owner"}
+	user.ID = id
+	return &user, nil
+}
+
+// fakeSessions logs in the user whose role is the session cookie.
+type fakeSessions struct {
+	models.SessionService
+	verified bool
+}
+
+func (fs *fakeSessions) Authenticate(token, ip string) (*models.User, *models.Session, error) {
+	id, ok := testUsers[token]
+	if !ok {
+		return nil, nil, models.ErrNotFound
+	}
+	user := models.User{Email: token + "@example.com"}
+	user.ID = id
+	if fs.verified {
+		now := time.Now()
+		user.VerifiedAt = &now
+	}
+	return &user, &models.Session{UserID: id}, nil
+}
+
+// newTestServer wires the gallery routes of main to fake services,
+// like main does without the database. Unverified users may not
+// perform the restricted actions.
+func newTestServer(verified bool, restricted ...policy.Action) http.Handler {
+	gs := &fakeGalleries{shareToken: testShareToken}
+	ms := &fakeMembers{}
+	is := &fakeImages{}
+	r := mux.NewRouter()
+	galleryPolicy := policy.New(gs, ms, restricted...)
+	galleriesC := controllers.NewGalleries(gs, is, ms, &fakeUsers{}, galleryPolicy, nil, *r)
+	userMw := middleware.User{SessionService: &fakeSessions{verified: verified}}
+	requireUserMw := middleware.RequireUser{User: userMw}
+	galleryMw := middleware.Gallery{Policy: galleryPolicy}
+	noLimit := newRateLimit(ratelimit.NewMemoryStore(), "upload", ratelimit.Limit{}, nil)
+
+	imagesC := controllers.NewImages(is, galleryPolicy)
+	trashC := controllers.NewTrash(&fakeTrash{}, gs)
+
+	galleryRoutes(r, galleriesC, imagesC, trashC, &requireUserMw, &galleryMw, noLimit)
+	apiR := r.PathPrefix("/api/v1").Subrouter()
+	apiRoutes(apiR, api.NewUsers(), api.NewGalleries(gs, is, ms, galleryPolicy), api.NewImages(is, galleryPolicy), noLimit)
+	return userMw.Apply(r)
+}
+
+// result is what a route responds with. Location is only checked
+// for redirects.
+type result struct {
+	Status   int
+	Location string
+}
+
+func (r result) String() string {
+	if r.Location == "" {
+		return http.StatusText(r.Status)
+	}
+	return http.StatusText(r.Status) + " to " + r.Location
+}
+
+var (
+	ok               = result{Status: http.StatusOK}
+	created          = result{Status: http.StatusCreated}
+	noContent        = result{Status: http.StatusNoContent}
+	badRequest       = result{Status: http.StatusBadRequest}
+	forbidden        = result{Status: http.StatusForbidden}
+	notFound         = result{Status: http.StatusNotFound}
+	methodNotAllowed = result{Status: http.StatusMethodNotAllowed}
+	toLogin          = result{Status: http.StatusFound, Location: "/login"}
+	unauthorized     = result{Status: http.StatusUnauthorized}
+)
+
+func redirect(location string) result {
+	return result{Status: http.StatusFound, Location: location}
+}
+
+// results is the result expected for each role.
+type results map[string]result
+
+func sameFor(roles []string, res result, others results) results {
+	all := results{}
+	for k, v := range others {
+		all[k] = v
+	}
+	for _, role := range roles {
+		all[role] = res
+	}
+	return all
+}
+
+var loggedIn = []string{owner, editor, contributor, viewer, nonMember}
+
+func TestGalleryRoutes(t *testing.T) {
+	gallery := "/galleries/10"
+	form := "application/x-www-form-urlencoded"
+	// What each role gets when the gallery lets them, or not, do
+	// something on a page or in the API.
+	var (
+		members   = results{owner: ok, editor: ok, contributor: ok, viewer: ok, nonMember: notFound, anonymous: notFound}
+		uploaders = results{owner: ok, editor: ok, contributor: ok, viewer: forbidden, nonMember: notFound, anonymous: toLogin}
+		editors   = results{owner: ok, editor: ok, contributor: forbidden, viewer: forbidden, nonMember: notFound, anonymous: toLogin}
+		onlyOwner = results{owner: ok, editor: forbidden, contributor: forbidden, viewer: forbidden, nonMember: notFound, anonymous: toLogin}
+		// notInTrash is what the roles get for things that are not
+		// in their own trash.
+		notInTrash = sameFor(loggedIn, notFound, results{anonymous: toLogin})
+	)
+	// with replaces the result of the roles that may do it.
+	with := func(base results, res result) results {
+		all := results{}
+		for role, r := range base {
+			if r == ok {
+				r = res
+			}
+			all[role] = r
+		}
+		return all
+	}
+	// inAPI replaces the redirects to the login page of anonymous
+	// visitors with the 401 of the API.
+	inAPI := func(base results) results {
+		return sameFor([]string{anonymous}, unauthorized, base)
+	}
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        results
+	}{
+		// Pages
+		{"GET", "/galleries", "", "", sameFor(loggedIn, ok, results{anonymous: toLogin})},
+		{"GET", "/galleries/new", "", "", sameFor(loggedIn, ok, results{anonymous: toLogin})},
+		{"POST", "/galleries/new", form, "title=Trip&visibility=private",
+			sameFor(loggedIn, redirect("/galleries/11/update"), results{anonymous: toLogin})},
+		{"GET", gallery, "", "", members},
+		{"GET", "/galleries/shared/" + testShareToken, "", "", sameFor(testRoles, ok, nil)},
+		{"GET", gallery + "/update", "", "", uploaders},
+		{"POST", gallery + "/update", form, "title=Renamed", editors},
+		{"POST", gallery + "/update", form, "title=Renamed&visibility=public",
+			sameFor([]string{editor}, forbidden, onlyOwner)},
+		{"POST", gallery + "/delete", form, "", with(onlyOwner, redirect("/galleries"))},
+		{"POST", gallery + "/share/rotate", form, "", with(onlyOwner, redirect(gallery+"/update"))},
+		// Without a multipart form the upload page shows an error.
+		{"POST", gallery + "/images", form, "", uploaders},
+		{"POST", gallery + "/images/photo.jpg/delete", form, "", with(editors, redirect(gallery+"/update"))},
+		{"GET", gallery + "/members", "", "", onlyOwner},
+		// Without an email address the members page shows an error.
+		{"POST", gallery + "/members", form, "email=&role=viewer", onlyOwner},
+		{"POST", gallery + "/members/20/update", form, "role=editor", with(onlyOwner, redirect(gallery+"/members"))},
+		{"POST", gallery + "/members/20/delete", form, "", with(onlyOwner, redirect(gallery+"/members"))},
+		// Unknown invitations show an error.
+		{"GET", "/invites/accept?token=nope", "", "", sameFor(loggedIn, ok, results{anonymous: toLogin})},
+		{"POST", "/invites/accept", form, "token=nope", sameFor(loggedIn, ok, results{anonymous: toLogin})},
+
+		// Image files
+		{"GET", "/images" + gallery + "/photo.jpg", "", "", members},
+		{"HEAD", "/images" + gallery + "/photo.jpg", "", "", members},
+		{"GET", "/images" + gallery + "/thumb/photo.jpg", "", "", members},
+		{"GET", "/images/galleries/11/photo.jpg", "", "", sameFor(testRoles, notFound, nil)},
+		{"GET", "/images/photo.jpg", "", "", sameFor(testRoles, notFound, nil)},
+		{"POST", "/images" + gallery + "/photo.jpg", form, "", sameFor(testRoles, methodNotAllowed, nil)},
+
+		// Trash, where only the owner of the gallery finds what was
+		// deleted from it.
+		{"GET", "/trash", "", "", sameFor(loggedIn, ok, results{anonymous: toLogin})},
+		{"POST", "/trash/galleries/10/restore", form, "", sameFor([]string{owner}, redirect("/trash"), notInTrash)},
+		{"POST", "/trash/galleries/11/restore", form, "", notInTrash},
+		{"POST", "/trash/images/30/restore", form, "", sameFor([]string{owner}, redirect("/trash"), notInTrash)},
+
+		// API
+		{"GET", "/api/v1/me", "", "", sameFor(loggedIn, ok, results{anonymous: unauthorized})},
+		{"GET", "/api/v1/galleries", "", "", sameFor(loggedIn, ok, results{anonymous: unauthorized})},
+		{"POST", "/api/v1/galleries", "application/json", `{"title": "Trip"}`,
+			sameFor(loggedIn, created, results{anonymous: unauthorized})},
+		{"GET", "/api/v1" + gallery, "", "", members},
+		{"PATCH", "/api/v1" + gallery, "application/json", `{"title": "Renamed"}`, inAPI(editors)},
+		{"PATCH", "/api/v1" + gallery, "application/json", `{"visibility": "public"}`, inAPI(onlyOwner)},
+		{"DELETE", "/api/v1" + gallery, "", "", inAPI(with(onlyOwner, noContent))},
+		{"GET", "/api/v1" + gallery + "/images", "", "", members},
+		// Without a multipart form the upload is refused.
+		{"POST", "/api/v1" + gallery + "/images", "application/json", "{}", inAPI(with(uploaders, badRequest))},
+		{"DELETE", "/api/v1" + gallery + "/images/photo.jpg", "", "", inAPI(with(editors, noContent))},
+	}
+	srv := newTestServer(true)
+	for _, tc := range tests {
+		for _, role := range testRoles {
+			t.Run(tc.method+" "+tc.path+"/"+role, func(t *testing.T) {
+				want, ok := tc.want[role]
+				if !ok {
+					t.Fatalf("no expectation for role %q", role)
+				}
+				if got := serve(srv, tc.method, tc.path, tc.contentType, tc.body, role); got != want {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// The images of an unlisted gallery can be seen with its share
+// link, until the share token is rotated.
+func TestRotateShareToken(t *testing.T) {
+	srv := newTestServer(true)
+	image := "/images/galleries/10/photo.jpg?share="
+	thumb := "/images/galleries/10/thumb/photo.jpg?share="
+	steps := []struct {
+		method string
+		path   string
+		role   string
+		want   result
+	}{
+		{"GET", "/galleries/shared/" + testShareToken, anonymous, ok},
+		{"GET", image + testShareToken, anonymous, ok},
+		{"GET", thumb + testShareToken, nonMember, ok},
+		{"GET", image + "nope", anonymous, notFound},
+		{"GET", "/images/galleries/11/photo.jpg?share=" + testShareToken, anonymous, notFound},
+		{"POST", "/galleries/10/share/rotate", owner, redirect("/galleries/10/update")},
+		{"GET", "/galleries/shared/" + testShareToken, anonymous, notFound},
+		{"GET", image + testShareToken, anonymous, notFound},
+		{"GET", thumb + testShareToken, nonMember, notFound},
+		{"GET", "/galleries/shared/" + rotatedShareToken, anonymous, ok},
+		{"GET", image + rotatedShareToken, anonymous, ok},
+		{"GET", thumb + rotatedShareToken, nonMember, ok},
+	}
+	for _, step := range steps {
+		if got := serve(srv, step.method, step.path, "", "", step.role); got != step.want {
+			t.Fatalf("%s %s as %s: got %v, want %v", step.method, step.path, step.role, got, step.want)
+		}
+	}
+}
+
+// The shared page links the images with the share token, so that
+// visitors who are not members can see them.
+func TestShowSharedImagePaths(t *testing.T) {
+	srv := newTestServer(true)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/galleries/shared/"+testShareToken, nil))
+	want := `href="/images/galleries/10/photo.jpg?share=` + testShareToken + `"`
+	if body := rec.Body.String(); !strings.Contains(body, want) {
+		t.Fatalf("got a page without %s", want)
+	}
+}
+
+// Unverified users are sent to verify their email address before
+// performing restricted actions, and only those.
+func TestGalleryRoutesUnverified(t *testing.T) {
+	srv := newTestServer(false, policy.ActionUpload, policy.ActionDeleteImages, policy.ActionShare)
+	form := "application/x-www-form-urlencoded"
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		role        string
+		want        result
+	}{
+		{"GET", "/galleries/10/update", "", "", editor, ok},
+		{"POST", "/galleries/10/images", form, "", editor, redirect("/account")},
+		{"POST", "/galleries/10/images/photo.jpg/delete", form, "", editor, redirect("/account")},
+		{"POST", "/galleries/10/update", form, "title=Renamed", editor, ok},
+		{"POST", "/galleries/10/update", form, "title=Renamed&visibility=private", owner, ok},
+		{"POST", "/galleries/10/update", form, "title=Renamed&visibility=public", owner, redirect("/account")},
+		{"POST", "/galleries/10/share/rotate", form, "", owner, redirect("/account")},
+		{"POST", "/api/v1/galleries/10/images", "application/json", "{}", editor, forbidden},
+		{"DELETE", "/api/v1/galleries/10/images/photo.jpg", "", "", editor, forbidden},
+		{"PATCH", "/api/v1/galleries/10", "application/json", `{"title": "Renamed"}`, owner, ok},
+		{"PATCH", "/api/v1/galleries/10", "application/json", `{"title": "Renamed", "visibility": "public"}`, owner, forbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path+" "+tc.body+"/"+tc.role, func(t *testing.T) {
+			if got := serve(srv, tc.method, tc.path, tc.contentType, tc.body, tc.role); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// serve sends the request as the user with the role, and returns
+// the result.
+func serve(srv http.Handler, method, path, contentType, body, role string) result {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if role != anonymous {
+		req.AddCookie(&http.Cookie{Name: middleware.SessionCookieName, Value: role})
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	res := result{Status: rec.Code}
+	if rec.Code == http.StatusFound {
+		loc, err := url.Parse(rec.Header().Get("Location"))
+		if err == nil {
+			res.Location = loc.Path
+		}
+	}
+	return res
+}
+
+// Assets and images have their own rate limit, so a page full of
+// images does not lock the visitor out of the other pages.
+func TestLimitByPath(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	static := newRateLimit(store, "static", ratelimit.Limit{PerMinute: 60, Burst: 5}, nil)
+	others := newRateLimit(store, "default", ratelimit.Limit{PerMinute: 1, Burst: 1}, nil)
+	srv := limitByPath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), static, others)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/galleries", http.StatusOK},
+		{"/galleries", http.StatusTooManyRequests},
+		{"/images/galleries/10/photo.jpg", http.StatusOK},
+		{"/assets/app.css", http.StatusOK},
+		{"/images/galleries/10/thumb/photo.jpg", http.StatusOK},
+		{"/galleries/10", http.StatusTooManyRequests},
+	}
+	for _, tc := range tests {
+		if got := serve(srv, "GET", tc.path, "", "", anonymous); got.Status != tc.want {
+			t.Fatalf("GET %s: got %v, want %v", tc.path, got, http.StatusText(tc.want))
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/policy"
+	"github.com/monkjunior/goweb.learn/views"
+)
+
+// Gallery looks up the gallery with the id found in the URL and
+// makes sure the current user may perform the action on it before
+// calling the next handler, which can get the gallery with
+// context.Gallery. The Role of the gallery is set to the role of
+// the current user.
+//
+// Unsafe requests are also refused when the action is restricted to
+// users who verified their email address.
+//
+// It assume that the User has already been run otherwise it will
+// not work correctly.
+type Gallery struct {
+	Policy *policy.Policy
+}
+
+func (mw *Gallery) Apply(action policy.Action, next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(action, next.ServeHTTP)
+}
+
+func (mw *Gallery) ApplyFn(action policy.Action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+			return
+		}
+		user := context.User(r.Context())
+		gallery, err := mw.Policy.Gallery(user, uint(id), action)
+		if err == nil && !safeMethod(r.Method) {
+			err = mw.Policy.Verified(user, action)
+		}
+		switch err {
+		case nil:
+		case policy.ErrUnverified:
+			views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+				Level:   views.AlertLvWarning,
+				Message: "Please verify your email address first. We can send you a new link below.",
+			})
+			return
+		case policy.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		case policy.ErrForbidden:
+			http.Error(w, "You do not have permission to do this", http.StatusForbidden)
+			return
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithGallery(r.Context(), gallery)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
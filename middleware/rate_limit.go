@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/monkjunior/goweb.learn/context"
+	"github.com/monkjunior/goweb.learn/ratelimit"
+)
+
+// RateLimit limits how often the same client may make requests to
+// the routes it wraps. Clients are the logged in user, or the IP of
+// the request for visitors. Name keeps the buckets of route groups
+// apart when they share a store.
+//
+// Every response gets the X-RateLimit-Limit, X-RateLimit-Remaining
+// and X-RateLimit-Reset headers. Requests over the limit get a 429
+// with a Retry-After header, written by Denied if it is set.
+//
+// Routes are not limited when Limiter is nil.
+//
+// It should run after User, so that users are limited as themselves
+// rather than by IP.
+type RateLimit struct {
+	Name    string
+	Limiter *ratelimit.Limiter
+	Denied  http.HandlerFunc
+}
+
+func (mw *RateLimit) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RateLimit) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	if mw.Limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := mw.Limiter.Take(mw.key(r))
+		if err != nil {
+			// Better to let requests through than to take the
+			// site down with the store.
+			log.Println(err)
+			next(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(seconds(res.Reset.Seconds())))
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter.Seconds())))
+			if mw.Denied != nil {
+				mw.Denied(w, r)
+				return
+			}
+			http.Error(w, "Too many requests. Please slow down.", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (mw *RateLimit) key(r *http.Request) string {
+	if user := context.User(r.Context()); user != nil {
+		return fmt.Sprintf("%s:user:%d", mw.Name, user.ID)
+	}
+	return fmt.Sprintf("%s:ip:%s", mw.Name, RemoteIP(r))
+}
+
+// seconds rounds up, so clients never retry too early.
+func seconds(s float64) int {
+	return int(math.Ceil(s))
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"net"
 	"net/http"
 	"strings"
 
@@ -8,8 +9,12 @@ import (
 	"github.com/monkjunior/goweb.learn/models"
 )
 
+// User looks up the session in the remember_token cookie and
+// stores its user in the request context. The cookie is renewed as
+// the session is used, and deleted once the session has expired.
 type User struct {
-	models.UserService
+	models.SessionService
+	Cookie SessionCookie
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
@@ -19,24 +24,36 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		// If a user is requesting a static assets for images, we will not need to lookup the current
-		// user.
-		if strings.HasPrefix(path, "/assets/") || strings.HasPrefix(path, "/images/") {
+		// If a user is requesting a static asset, we will not need to lookup the current
+		// user. Images are not skipped, since private galleries only show them to members.
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
-		cookie, err := r.Cookie("remember_token")
+		// The user may already be authenticated with an API token.
+		if context.User(r.Context()) != nil {
+			next(w, r)
+			return
+		}
+		cookie, err := r.Cookie(SessionCookieName)
 		if err != nil {
 			next(w, r)
 			return
 		}
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		user, session, err := mw.SessionService.Authenticate(cookie.Value, RemoteIP(r))
 		if err != nil {
+			if err == models.ErrNotFound {
+				mw.Cookie.Clear(w)
+			}
 			next(w, r)
 			return
 		}
+		if session.Renewed {
+			mw.Cookie.Set(w, session)
+		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 		next(w, r)
 	}
@@ -66,3 +83,12 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	})
 }
+
+// RemoteIP returns the IP address the request came from.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
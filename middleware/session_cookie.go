@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/models"
+)
+
+const (
+	// SessionCookieName is the name of the cookie holding the
+	// session token of logged in users.
+	SessionCookieName = "remember_token"
+	// PendingCookieName is the name of the cookie holding the
+	// token of a pending session, while we wait for the second
+	// factor of the user. It is only sent to the login pages.
+	PendingCookieName = "second_factor"
+	pendingCookiePath = "/login"
+	// ProviderCookieName is the name of the cookie holding the
+	// state of a login with an identity provider, until it sends
+	// the user back to us.
+	ProviderCookieName = "provider_login"
+	providerCookiePath = "/auth"
+)
+
+// SessionCookie writes the cookies holding session tokens.
+// Secure should be true in production, where we are served over
+// HTTPS, so that the cookies are never sent in clear text.
+type SessionCookie struct {
+	Secure bool
+}
+
+// Set will write the cookie for the session, expiring when the
+// session would expire if it is not used again.
+func (sc SessionCookie) Set(w http.ResponseWriter, session *models.Session) {
+	http.SetCookie(w, sc.cookie(SessionCookieName, "/", session.Token, session.CookieExpiresAt()))
+}
+
+// Clear will tell the browser to delete the cookie.
+func (sc SessionCookie) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, sc.cookie(SessionCookieName, "/", "", time.Time{}))
+}
+
+// SetPending will write the cookie for a pending session.
+func (sc SessionCookie) SetPending(w http.ResponseWriter, session *models.Session) {
+	http.SetCookie(w, sc.cookie(PendingCookieName, pendingCookiePath, session.Token, session.ExpiresAt))
+}
+
+// ClearPending will tell the browser to delete the cookie of the
+// pending session.
+func (sc SessionCookie) ClearPending(w http.ResponseWriter) {
+	http.SetCookie(w, sc.cookie(PendingCookieName, pendingCookiePath, "", time.Time{}))
+}
+
+// SetProvider will write the cookie holding the state of a login
+// with an identity provider.
+func (sc SessionCookie) SetProvider(w http.ResponseWriter, value string, expiresAt time.Time) {
+	http.SetCookie(w, sc.cookie(ProviderCookieName, providerCookiePath, value, expiresAt))
+}
+
+// ClearProvider will tell the browser to delete the cookie holding
+// the state of a login with an identity provider.
+func (sc SessionCookie) ClearProvider(w http.ResponseWriter) {
+	http.SetCookie(w, sc.cookie(ProviderCookieName, providerCookiePath, "", time.Time{}))
+}
+
+// cookie builds a cookie expiring at expiresAt, or deleting the
+// cookie if expiresAt is zero.
+func (sc SessionCookie) cookie(name, path, value string, expiresAt time.Time) *http.Cookie {
+	maxAge := int(time.Until(expiresAt).Seconds())
+	if expiresAt.IsZero() {
+		expiresAt = time.Unix(0, 0)
+		maxAge = -1
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expiresAt,
+		MaxAge:   maxAge,
+		Secure:   sc.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
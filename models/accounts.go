@@ -0,0 +1,292 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/storage"
+	"gorm.io/gorm"
+)
+
+// AccountService works on everything a user owns at once, to export
+// or delete it.
+type AccountService interface {
+	// Export will write a ZIP archive of the data we keep about
+	// the user to w: a manifest.json file describing the user and
+	// their galleries, and the original images of those galleries.
+	Export(user *User, w io.Writer) error
+	// Delete will permanently delete the user along with their
+	// galleries, the images they uploaded and everything else
+	// linked to them, then remove the image files from the store.
+	Delete(user *User) error
+	// DeleteScheduled will delete every user whose deletion grace
+	// period is over, and returns how many were deleted.
+	DeleteScheduled() (int, error)
+}
+
+func NewAccountService(db *gorm.DB, store storage.Store) AccountService {
+	return &accountService{
+		db:    db,
+		store: store,
+	}
+}
+
+type accountService struct {
+	db    *gorm.DB
+	store storage.Store
+}
+
+// exportManifest is the manifest.json file of an export.
+type exportManifest struct {
+	ExportedAt  time.Time          `json:"exported_at"`
+	User        exportUser         `json:"user"`
+	Galleries   []exportGallery    `json:"galleries"`
+	Memberships []exportMembership `json:"memberships"`
+	Identities  []exportIdentity   `json:"identities"`
+	Sessions    []exportSession    `json:"sessions"`
+	APITokens   []exportAPIToken   `json:"api_tokens"`
+}
+
+type exportUser struct {
+	ID                uint       `json:"id"`
+	Name              string     `json:"name"`
+	Email             string     `json:"email"`
+	CreatedAt         time.Time  `json:"created_at"`
+	VerifiedAt        *time.Time `json:"verified_at"`
+	KeepImageMetadata bool       `json:"keep_image_metadata"`
+	TwoFactorEnabled  bool       `json:"two_factor_enabled"`
+	DeleteAt          *time.Time `json:"delete_at,omitempty"`
+}
+
+type exportGallery struct {
+	ID         uint          `json:"id"`
+	Title      string        `json:"title"`
+	Visibility string        `json:"visibility"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Images     []exportImage `json:"images"`
+}
+
+type exportImage struct {
+	// File is the path of the image in the archive, empty if the
+	// file could not be read from the store.
+	File             string     `json:"file"`
+	OriginalFilename string     `json:"original_filename"`
+	Caption          string     `json:"caption"`
+	ContentType      string     `json:"content_type"`
+	Size             int64      `json:"size"`
+	Width            int        `json:"width"`
+	Height           int        `json:"height"`
+	CapturedAt       *time.Time `json:"captured_at"`
+	Camera           string     `json:"camera"`
+	LensModel        string     `json:"lens_model"`
+	UploadedBy       uint       `json:"uploaded_by"`
+	UploadedAt       time.Time  `json:"uploaded_at"`
+}
+
+type exportMembership struct {
+	GalleryID uint      `json:"gallery_id"`
+	Role      string    `json:"role"`
+	Since     time.Time `json:"since"`
+}
+
+type exportIdentity struct {
+	Provider string    `json:"provider"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+type exportSession struct {
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+type exportAPIToken struct {
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func (as *accountService) Export(user *User, w io.Writer) error {
+	manifest := exportManifest{
+		ExportedAt: time.Now(),
+		User: exportUser{
+			ID:                user.ID,
+			Name:              user.Name,
+			Email:             user.Email,
+			CreatedAt:         user.CreatedAt,
+			VerifiedAt:        user.VerifiedAt,
+			KeepImageMetadata: user.KeepImageMetadata,
+			TwoFactorEnabled:  user.TOTPEnabled,
+			DeleteAt:          user.DeleteAt,
+		},
+	}
+	var galleries []Gallery
+	if err := as.db.Where("user_id = ?", user.ID).Order("id").Find(&galleries).Error; err != nil {
+		return err
+	}
+	var members []Member
+	if err := as.db.Where("user_id = ?", user.ID).Order("id").Find(&members).Error; err != nil {
+		return err
+	}
+	var identities []Identity
+	if err := as.db.Where("user_id = ?", user.ID).Order("id").Find(&identities).Error; err != nil {
+		return err
+	}
+	var sessions []Session
+	if err := as.db.Where("user_id = ? AND pending = ?", user.ID, false).Order("id").Find(&sessions).Error; err != nil {
+		return err
+	}
+	var tokens []APIToken
+	if err := as.db.Where("user_id = ?", user.ID).Order("id").Find(&tokens).Error; err != nil {
+		return err
+	}
+	for _, m := range members {
+		manifest.Memberships = append(manifest.Memberships, exportMembership{GalleryID: m.GalleryID, Role: m.Role, Since: m.CreatedAt})
+	}
+	for _, i := range identities {
+		manifest.Identities = append(manifest.Identities, exportIdentity{Provider: i.Provider, Email: i.Email, LinkedAt: i.CreatedAt})
+	}
+	for _, s := range sessions {
+		manifest.Sessions = append(manifest.Sessions, exportSession{IP: s.IP, UserAgent: s.UserAgent, CreatedAt: s.CreatedAt, LastSeenAt: s.LastSeenAt})
+	}
+	for _, t := range tokens {
+		manifest.APITokens = append(manifest.APITokens, exportAPIToken{Name: t.Name, Scope: t.Scope, CreatedAt: t.CreatedAt, LastUsedAt: t.LastUsedAt})
+	}
+
+	zw := zip.NewWriter(w)
+	for _, g := range galleries {
+		eg := exportGallery{
+			ID:         g.ID,
+			Title:      g.Title,
+			Visibility: g.Visibility,
+			CreatedAt:  g.CreatedAt,
+		}
+		var images []Image
+		if err := as.db.Where("gallery_id = ?", g.ID).Order("position, id").Find(&images).Error; err != nil {
+			return err
+		}
+		for _, img := range images {
+			file := path.Join("galleries", fmt.Sprint(g.ID), img.Filename)
+			if err := as.exportFile(zw, file, img.Key()); err != nil {
+				if err != storage.ErrNotFound {
+					return err
+				}
+				log.Printf("accounts: exporting %s: %v\n", img.Key(), err)
+				file = ""
+			}
+			eg.Images = append(eg.Images, exportImage{
+				File:             file,
+				OriginalFilename: img.OriginalFilename,
+				Caption:          img.Caption,
+				ContentType:      img.ContentType,
+				Size:             img.Size,
+				Width:            img.Width,
+				Height:           img.Height,
+				CapturedAt:       img.CapturedAt,
+				Camera:           img.Camera(),
+				LensModel:        img.LensModel,
+				UploadedBy:       img.UserID,
+				UploadedAt:       img.CreatedAt,
+			})
+		}
+		manifest.Galleries = append(manifest.Galleries, eg)
+	}
+
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// exportFile will copy the object stored under key to the archive.
+// Images are already compressed, so they are stored as they are.
+func (as *accountService) exportFile(zw *zip.Writer, name, key string) error {
+	rc, obj, err := as.store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: obj.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	return err
+}
+
+func (as *accountService) Delete(user *User) error {
+	if user.ID <= 0 {
+		return ErrIDInvalid
+	}
+	// Files cannot be rolled back, so they are only removed once
+	// the rows are gone.
+	var galleryIDs []uint
+	var uploads []Image
+	err := as.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&Gallery{}).Where("user_id = ?", user.ID).Pluck("id", &galleryIDs).Error
+		if err != nil {
+			return err
+		}
+		if err := deleteGalleries(tx, galleryIDs); err != nil {
+			return err
+		}
+		// What is left are the images uploaded to the galleries of
+		// other users.
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Find(&uploads).Error; err != nil {
+			return err
+		}
+		if err := deleteImages(tx, uploads); err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&Member{}, &APIToken{}, &Session{}, &RecoveryCode{},
+			&Identity{}, &pwReset{}, &emailVerification{}, &magicLink{}} {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("email = ?", user.Email).Delete(&Invite{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&User{}, user.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+	removeGalleryFiles(as.store, galleryIDs)
+	removeImageFiles(as.store, uploads)
+	return nil
+}
+
+func (as *accountService) DeleteScheduled() (int, error) {
+	var users []User
+	err := as.db.Where("delete_at IS NOT NULL AND delete_at <= ?", time.Now()).Find(&users).Error
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range users {
+		if err := as.Delete(&users[i]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/hash"
+	"github.com/monkjunior/goweb.learn/rand"
+	"gorm.io/gorm"
+)
+
+// Scopes an API token can have.
+const (
+	// ScopeRead only allows safe requests, such as GET.
+	ScopeRead = "read"
+	// ScopeReadWrite allows every request the user could make.
+	ScopeReadWrite = "read_write"
+)
+
+// apiTokenUsedEvery is how often we record that a token was used,
+// so we do not write to the database on every request.
+const apiTokenUsedEvery = time.Minute
+
+// APIToken is a personal token used by scripts and other clients
+// that are not browsers to authenticate as a user.
+type APIToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Scope      string `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;uniqueIndex"`
+	LastUsedAt *time.Time
+}
+
+// CanWrite reports whether the token allows requests that change
+// data.
+func (t *APIToken) CanWrite() bool {
+	return t.Scope == ScopeReadWrite
+}
+
+// APITokenService is used to manage and check API tokens.
+type APITokenService interface {
+	// Authenticate will look up the token and the user it belongs
+	// to. ErrNotFound is returned if the token is not valid.
+	Authenticate(token string) (*User, *APIToken, error)
+	APITokenDB
+}
+
+type APITokenDB interface {
+	// Methods for querying API tokens
+	ByID(id uint) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+	ByToken(token string) (*APIToken, error)
+
+	// Methods for altering API tokens
+	Create(token *APIToken) error
+	MarkUsed(id uint, at time.Time) error
+	Delete(id uint) error
+}
+
+func NewAPITokenService(db *gorm.DB, us UserService, hmacKey string) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			APITokenDB: &apiTokenGorm{
+				db: db,
+			},
+			hmac: hash.NewHMAC(hmacKey),
+		},
+		us: us,
+	}
+}
+
+type apiTokenService struct {
+	APITokenDB
+	us UserService
+}
+
+func (ats *apiTokenService) Authenticate(token string) (*User, *APIToken, error) {
+	apiToken, err := ats.ByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := ats.us.ByID(apiToken.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) > apiTokenUsedEvery {
+		if err := ats.MarkUsed(apiToken.ID, now); err != nil {
+			return nil, nil, err
+		}
+		apiToken.LastUsedAt = &now
+	}
+	return user, apiToken, nil
+}
+
+type apiTokenValFunc func(*APIToken) error
+
+func runAPITokenValFuncs(token *APIToken, fns ...apiTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+func (atv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	t := APIToken{Token: token}
+	if err := runAPITokenValFuncs(&t, atv.tokenPrefix, atv.hmacToken); err != nil {
+		return nil, err
+	}
+	return atv.APITokenDB.ByToken(t.TokenHash)
+}
+
+func (atv *apiTokenValidator) Create(token *APIToken) error {
+	err := runAPITokenValFuncs(token,
+		atv.userIDRequired,
+		atv.normalizeName,
+		atv.nameRequired,
+		atv.scopeValid,
+		atv.setTokenIfUnset,
+		atv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return atv.APITokenDB.Create(token)
+}
+
+func (atv *apiTokenValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return atv.APITokenDB.Delete(id)
+}
+
+func (atv *apiTokenValidator) userIDRequired(t *APIToken) error {
+	if t.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) normalizeName(t *APIToken) error {
+	t.Name = strings.TrimSpace(t.Name)
+	return nil
+}
+
+func (atv *apiTokenValidator) nameRequired(t *APIToken) error {
+	if t.Name == "" {
+		return ErrTokenNameRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) scopeValid(t *APIToken) error {
+	switch t.Scope {
+	case ScopeRead, ScopeReadWrite:
+		return nil
+	}
+	return ErrScopeInvalid
+}
+
+func (atv *apiTokenValidator) setTokenIfUnset(t *APIToken) error {
+	if t.Token != "" {
+		return nil
+	}
+	token, err := rand.APIToken()
+	if err != nil {
+		return err
+	}
+	t.Token = token
+	return nil
+}
+
+// tokenPrefix makes sure the token looks like one of ours before
+// we hit the database.
+func (atv *apiTokenValidator) tokenPrefix(t *APIToken) error {
+	if !strings.HasPrefix(t.Token, rand.APITokenPrefix) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) hmacToken(t *APIToken) error {
+	if t.Token == "" {
+		return nil
+	}
+	t.TokenHash = atv.hmac.Hash(t.Token)
+	return nil
+}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+func (atg *apiTokenGorm) ByID(id uint) (*APIToken, error) {
+	var t APIToken
+	err := first(atg.db.Where("id = ?", id), &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (atg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := atg.db.Where("user_id = ?", userID).Order("id").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (atg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var t APIToken
+	err := first(atg.db.Where("token_hash = ?", tokenHash), &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (atg *apiTokenGorm) Create(token *APIToken) error {
+	return atg.db.Create(token).Error
+}
+
+func (atg *apiTokenGorm) MarkUsed(id uint, at time.Time) error {
+	return atg.db.Model(&APIToken{}).Where("id = ?", id).
+		UpdateColumn("last_used_at", at).Error
+}
+
+// Delete will remove the token for good, so that it can never be
+// used again.
+func (atg *apiTokenGorm) Delete(id uint) error {
+	return atg.db.Unscoped().Delete(&APIToken{}, id).Error
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"github.com/monkjunior/goweb.learn/hash"
+	"github.com/monkjunior/goweb.learn/rand"
+	"gorm.io/gorm"
+)
+
+// emailVerification is the token we email to prove a user owns an
+// address. Email is the address it was sent to, so a token stops
+// working if the user changes their email in the meantime.
+type emailVerification struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+}
+
+type emailVerificationDB interface {
+	ByToken(token string) (*emailVerification, error)
+	Create(ev *emailVerification) error
+	DeleteByUserID(userID uint) error
+}
+
+func newEmailVerificationValidator(evDB emailVerificationDB, hmac hash.HMAC) *emailVerificationValidator {
+	return &emailVerificationValidator{
+		emailVerificationDB: evDB,
+		hmac:                hmac,
+	}
+}
+
+type emailVerificationValidator struct {
+	emailVerificationDB
+	hmac hash.HMAC
+}
+
+func (evv *emailVerificationValidator) ByToken(token string) (*emailVerification, error) {
+	ev := emailVerification{Token: token}
+	err := runEmailVerificationValFns(&ev, evv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return evv.emailVerificationDB.ByToken(ev.TokenHash)
+}
+
+func (evv *emailVerificationValidator) Create(ev *emailVerification) error {
+	err := runEmailVerificationValFns(ev,
+		evv.requireUserID,
+		evv.setTokenIfUnset,
+		evv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return evv.emailVerificationDB.Create(ev)
+}
+
+func (evv *emailVerificationValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return evv.emailVerificationDB.DeleteByUserID(userID)
+}
+
+type emailVerificationGorm struct {
+	db *gorm.DB
+}
+
+func (evg *emailVerificationGorm) ByToken(tokenHash string) (*emailVerification, error) {
+	var ev emailVerification
+	err := first(evg.db.Where("token_hash = ?", tokenHash), &ev)
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (evg *emailVerificationGorm) Create(ev *emailVerification) error {
+	return evg.db.Create(ev).Error
+}
+
+func (evg *emailVerificationGorm) DeleteByUserID(userID uint) error {
+	return evg.db.Where("user_id = ?", userID).Delete(&emailVerification{}).Error
+}
+
+func runEmailVerificationValFns(ev *emailVerification, fns ...emailVerificationValFn) error {
+	for _, f := range fns {
+		err := f(ev)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type emailVerificationValFn func(*emailVerification) error
+
+func (evv *emailVerificationValidator) requireUserID(ev *emailVerification) error {
+	if ev.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) setTokenIfUnset(ev *emailVerification) error {
+	if ev.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ev.Token = token
+	return nil
+}
+
+func (evv *emailVerificationValidator) hmacToken(ev *emailVerification) error {
+	if ev.Token == "" {
+		return nil
+	}
+	ev.TokenHash = evv.hmac.Hash(ev.Token)
+	return nil
+}
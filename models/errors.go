@@ -3,20 +3,45 @@ package models
 import "strings"
 
 var (
-	ErrNotFound          modelError = "models: resource not found"
-	ErrEmailRequired     modelError = "models: email address is required"
-	ErrEmailInvalid      modelError = "models: email provided was invalid"
-	ErrEmailIsTaken      modelError = "models: email address has already taken"
-	ErrPasswordIncorrect modelError = "models: incorrect password provided"
-	ErrPasswordRequired  modelError = "models: password is required"
-	ErrPasswordTooShort  modelError = "models: password must be at least 8 charaters"
-	ErrRememberRequired  modelError = "models: remember is required"
-	ErrTitleRequired     modelError = "models: title is required"
-	ErrPwResetInvalid    modelError = "models: token provided is not valid"
-
-	ErrIDInvalid        privateError = "models: ID provided was invalid"
-	ErrRememberTooShort privateError = "models: remember token must be at least 32 bytes"
-	ErrUserIDRequired   privateError = "models: userID is required"
+	ErrNotFound             modelError = "models: resource not found"
+	ErrEmailRequired        modelError = "models: email address is required"
+	ErrEmailInvalid         modelError = "models: email provided was invalid"
+	ErrEmailIsTaken         modelError = "models: email address has already taken"
+	ErrPasswordIncorrect    modelError = "models: incorrect password provided"
+	ErrCredentialsInvalid   modelError = "models: email address or password is incorrect"
+	ErrPasswordRequired     modelError = "models: password is required"
+	ErrRememberRequired     modelError = "models: remember is required"
+	ErrTitleRequired        modelError = "models: title is required"
+	ErrVisibilityInvalid    modelError = "models: visibility must be private, unlisted or public"
+	ErrRoleInvalid          modelError = "models: role must be viewer, contributor, editor or owner"
+	ErrInviteInvalid        modelError = "models: invitation is not valid or has expired"
+	ErrInviteEmailMismatch  modelError = "models: invitation was sent to a different email address"
+	ErrPwResetInvalid       modelError = "models: token provided is not valid"
+	ErrVerificationInvalid  modelError = "models: verification link is not valid or has expired"
+	ErrMagicLinkInvalid     modelError = "models: login link is not valid or has expired"
+	ErrDeletionLinkInvalid  modelError = "models: deletion link is not valid or has expired"
+	ErrEmailAlreadyVerified modelError = "models: email address is already verified"
+	ErrFilenameRequired     modelError = "models: filename is required"
+	ErrImageEmpty           modelError = "models: image file is empty"
+	ErrImageTooLarge        modelError = "models: image file must be at most 10MB"
+	ErrImageTooManyPixels   modelError = "models: image must be at most 50 megapixels"
+	ErrImageTypeInvalid     modelError = "models: only JPEG, PNG, GIF and WebP images are allowed"
+	ErrImageInvalid         modelError = "models: image file could not be read"
+	ErrImageUploadTooLarge  modelError = "models: images uploaded at once must be at most 50MB in total"
+	ErrTokenNameRequired    modelError = "models: token name is required"
+	ErrScopeInvalid         modelError = "models: scope must be read or read_write"
+	ErrCodeInvalid          modelError = "models: authentication code is not valid"
+	ErrTwoFactorEnabled     modelError = "models: two-factor authentication is already enabled"
+	ErrTwoFactorNotEnabled  modelError = "models: two-factor authentication is not enabled"
+	ErrIdentityTaken        modelError = "models: this account is already linked to another user"
+	ErrLastLogin            modelError = "models: set a password before unlinking your only way to log in"
+
+	ErrIDInvalid         privateError = "models: ID provided was invalid"
+	ErrRememberTooShort  privateError = "models: remember token must be at least 32 bytes"
+	ErrUserIDRequired    privateError = "models: userID is required"
+	ErrGalleryIDRequired privateError = "models: galleryID is required"
+	ErrFilenameInvalid   privateError = "models: filename provided was invalid"
+	ErrIdentityInvalid   privateError = "models: provider and subject are required"
 )
 
 type modelError string
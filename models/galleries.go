@@ -1,13 +1,85 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"sort"
+
+	"github.com/monkjunior/goweb.learn/rand"
+	"gorm.io/gorm"
+)
+
+// Orders the images of a gallery can be sorted in.
+const (
+	ImageSortPosition = "position"
+	ImageSortCaptured = "captured"
+	ImageSortUploaded = "uploaded"
+)
+
+// Visibilities a gallery can have.
+const (
+	// VisibilityPrivate galleries can only be seen by their owner.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries can be seen by anyone who has
+	// their share link.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries can be seen by anyone.
+	VisibilityPublic = "public"
+)
 
 // Gallery is our image container resources
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID     uint    `gorm:"not_null;index"`
+	Title      string  `gorm:"not_null"`
+	Visibility string  `gorm:"not null;default:private"`
+	ShareToken string  `gorm:"index"`
+	Images     []Image `gorm:"-"`
+	// Role is the role of the user viewing the gallery, set by
+	// the controllers so templates know which actions to show.
+	Role string `gorm:"-"`
+}
+
+// CanUpload reports whether Role allows uploading images.
+func (g *Gallery) CanUpload() bool {
+	return RoleCan(g.Role, PermUpload)
+}
+
+// CanDeleteImages reports whether Role allows deleting images.
+func (g *Gallery) CanDeleteImages() bool {
+	return RoleCan(g.Role, PermDeleteImages)
+}
+
+// CanRename reports whether Role allows changing the title.
+func (g *Gallery) CanRename() bool {
+	return RoleCan(g.Role, PermRename)
+}
+
+// CanDelete reports whether Role allows deleting the gallery.
+func (g *Gallery) CanDelete() bool {
+	return RoleCan(g.Role, PermDeleteGallery)
+}
+
+// CanManageMembers reports whether Role allows managing members
+// and sharing.
+func (g *Gallery) CanManageMembers() bool {
+	return RoleCan(g.Role, PermManageMembers)
+}
+
+// SharePath is used to build the path of the share link of an
+// unlisted gallery.
+func (g *Gallery) SharePath() string {
+	return "/galleries/shared/" + g.ShareToken
+}
+
+// IsPublic reports whether anyone can see the gallery without
+// its share link.
+func (g *Gallery) IsPublic() bool {
+	return g.Visibility == VisibilityPublic
+}
+
+// IsShared reports whether anyone with the share link can see
+// the gallery.
+func (g *Gallery) IsShared() bool {
+	return g.Visibility == VisibilityUnlisted || g.Visibility == VisibilityPublic
 }
 
 type GalleryService interface {
@@ -18,6 +90,8 @@ type GalleryDB interface {
 	// Methods for querying for a single gallery
 	ByID(id uint) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
+	ByIDs(ids []uint) ([]Gallery, error)
+	ByShareToken(token string) (*Gallery, error)
 
 	// Methods for altering galleries
 	Create(gallery *Gallery) error
@@ -54,10 +128,22 @@ type galleryValidator struct {
 	GalleryDB
 }
 
+// ByShareToken will make sure a token was provided, since
+// galleries created before share links existed have none.
+func (gv *galleryValidator) ByShareToken(token string) (*Gallery, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return gv.GalleryDB.ByShareToken(token)
+}
+
 func (gv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValFuncs(gallery,
 		gv.titleRequired,
 		gv.userIDRequired,
+		gv.visibilityDefault,
+		gv.visibilityValid,
+		gv.setShareTokenIfUnset,
 	)
 	if err != nil {
 		return err
@@ -65,10 +151,15 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 	return gv.GalleryDB.Create(gallery)
 }
 
+// Update will validate the gallery and generate a new share token
+// if it was cleared, which is how share links are revoked.
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFuncs(gallery,
 		gv.titleRequired,
 		gv.userIDRequired,
+		gv.visibilityDefault,
+		gv.visibilityValid,
+		gv.setShareTokenIfUnset,
 	)
 	if err != nil {
 		return err
@@ -100,6 +191,33 @@ func (gv *galleryValidator) userIDRequired(gallery *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) visibilityDefault(gallery *Gallery) error {
+	if gallery.Visibility == "" {
+		gallery.Visibility = VisibilityPrivate
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(gallery *Gallery) error {
+	switch gallery.Visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return nil
+	}
+	return ErrVisibilityInvalid
+}
+
+func (gv *galleryValidator) setShareTokenIfUnset(gallery *Gallery) error {
+	if gallery.ShareToken != "" {
+		return nil
+	}
+	token, err := rand.ShareToken()
+	if err != nil {
+		return err
+	}
+	gallery.ShareToken = token
+	return nil
+}
+
 func (gv *galleryValidator) idGreaterThan(n uint) galleryValFunc {
 	return func(g *Gallery) error {
 		if g.ID <= n {
@@ -133,6 +251,28 @@ func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+// ByIDs will list all galleries with the provided IDs.
+func (gg *galleryGorm) ByIDs(ids []uint) ([]Gallery, error) {
+	var galleries []Gallery
+	if len(ids) == 0 {
+		return galleries, nil
+	}
+	if err := gg.db.Where("id IN ?", ids).Order("id").Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// ByShareToken will look up the gallery with the provided share token.
+func (gg *galleryGorm) ByShareToken(token string) (*Gallery, error) {
+	var gallery Gallery
+	err := first(gg.db.Where("share_token = ?", token), &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
 // Create will create the provided gallery and backfill data
 // like the ID, CreatedAt, and UpdatedAt fields.
 func (gg *galleryGorm) Create(gallery *Gallery) error {
@@ -179,3 +319,23 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	}
 	return ret
 }
+
+// SortImages will sort the images of the gallery in the provided
+// order. Images without a capture date are placed last when
+// sorting by capture date. Unknown orders keep the display order.
+func (g *Gallery) SortImages(by string) {
+	switch by {
+	case ImageSortCaptured:
+		sort.SliceStable(g.Images, func(i, j int) bool {
+			a, b := g.Images[i].CapturedAt, g.Images[j].CapturedAt
+			if a == nil || b == nil {
+				return a != nil
+			}
+			return a.Before(*b)
+		})
+	case ImageSortUploaded:
+		sort.SliceStable(g.Images, func(i, j int) bool {
+			return g.Images[i].CreatedAt.Before(g.Images[j].CreatedAt)
+		})
+	}
+}
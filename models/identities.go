@@ -0,0 +1,185 @@
+package models
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Identity links a user to their account with an identity
+// provider, so they can log in there instead of with a password.
+type Identity struct {
+	gorm.Model
+	UserID uint `gorm:"not null;index"`
+	// Provider is the name of the identity provider in the config
+	// and Subject the ID of the account there.
+	Provider string `gorm:"not null;uniqueIndex:idx_identities_provider_subject"`
+	Subject  string `gorm:"not null;uniqueIndex:idx_identities_provider_subject"`
+	// Email is the email address of the account when it was
+	// linked, to help users tell their identities apart.
+	Email string
+}
+
+// IdentityService is used to link users to identity providers.
+type IdentityService interface {
+	// Unlink will delete the identity of the user with the ID. It
+	// returns ErrLastLogin if the user would have no way left to
+	// log in.
+	Unlink(user *User, id uint) error
+	IdentityDB
+}
+
+type IdentityDB interface {
+	// Methods for querying identities
+	ByID(id uint) (*Identity, error)
+	ByProviderSubject(provider, subject string) (*Identity, error)
+	ByUserID(userID uint) ([]Identity, error)
+
+	// Methods for altering identities
+	Create(identity *Identity) error
+	Delete(id uint) error
+}
+
+func NewIdentityService(db *gorm.DB) IdentityService {
+	return &identityService{
+		IdentityDB: &identityValidator{
+			IdentityDB: &identityGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+type identityService struct {
+	IdentityDB
+}
+
+func (is *identityService) Unlink(user *User, id uint) error {
+	identity, err := is.ByID(id)
+	if err != nil {
+		return err
+	}
+	if identity.UserID != user.ID {
+		return ErrNotFound
+	}
+	if !user.HasPassword() {
+		identities, err := is.ByUserID(user.ID)
+		if err != nil {
+			return err
+		}
+		if len(identities) <= 1 {
+			return ErrLastLogin
+		}
+	}
+	return is.Delete(id)
+}
+
+type identityValFunc func(*Identity) error
+
+func runIdentityValFuncs(identity *Identity, fns ...identityValFunc) error {
+	for _, fn := range fns {
+		if err := fn(identity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type identityValidator struct {
+	IdentityDB
+}
+
+func (iv *identityValidator) Create(identity *Identity) error {
+	err := runIdentityValFuncs(identity,
+		iv.userIDRequired,
+		iv.providerSubjectRequired,
+		iv.normalizeEmail,
+		iv.notLinked,
+	)
+	if err != nil {
+		return err
+	}
+	return iv.IdentityDB.Create(identity)
+}
+
+func (iv *identityValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.IdentityDB.Delete(id)
+}
+
+func (iv *identityValidator) userIDRequired(i *Identity) error {
+	if i.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *identityValidator) providerSubjectRequired(i *Identity) error {
+	if i.Provider == "" || i.Subject == "" {
+		return ErrIdentityInvalid
+	}
+	return nil
+}
+
+func (iv *identityValidator) normalizeEmail(i *Identity) error {
+	i.Email = strings.ToLower(strings.TrimSpace(i.Email))
+	return nil
+}
+
+// notLinked makes sure the account with the provider is not linked
+// to a user yet.
+func (iv *identityValidator) notLinked(i *Identity) error {
+	_, err := iv.ByProviderSubject(i.Provider, i.Subject)
+	switch err {
+	case nil:
+		return ErrIdentityTaken
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+func (ig *identityGorm) ByID(id uint) (*Identity, error) {
+	var identity Identity
+	err := first(ig.db.Where("id = ?", id), &identity)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByProviderSubject(provider, subject string) (*Identity, error) {
+	var identity Identity
+	db := ig.db.Where("provider = ? AND subject = ?", provider, subject)
+	err := first(db, &identity)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByUserID(userID uint) ([]Identity, error) {
+	var identities []Identity
+	err := ig.db.Where("user_id = ?", userID).Order("id").Find(&identities).Error
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (ig *identityGorm) Create(identity *Identity) error {
+	return ig.db.Create(identity).Error
+}
+
+// Delete will remove the identity for good, so the account with the
+// provider can be linked again.
+func (ig *identityGorm) Delete(id uint) error {
+	return ig.db.Unscoped().Delete(&Identity{}, id).Error
+}
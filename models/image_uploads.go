@@ -0,0 +1,252 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	// Register the decoders for the image formats we accept so
+	// that image.DecodeConfig can read their dimensions.
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/monkjunior/goweb.learn/exif"
+	"github.com/monkjunior/goweb.learn/rand"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// MaxImageBytes is the largest image file we accept.
+	MaxImageBytes = 10 << 20
+	// MaxImagePixels is the largest number of pixels (width * height)
+	// an image may have. This protects us from small files that
+	// decode into huge images.
+	MaxImagePixels = 50000000
+	// MaxImageUploadBytes is the largest total size of the images
+	// uploaded in a single request.
+	MaxImageUploadBytes = 50 << 20
+)
+
+// imageExtensions lists the content types we accept, keyed by
+// the type reported by http.DetectContentType, along with the
+// extension used for the stored file.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageFilenameRegex matches the file names we generate for
+// stored images.
+var imageFilenameRegex = regexp.MustCompile(`^[0-9a-f]{32}\.(jpg|png|gif|webp)$`)
+
+// maxOriginalFilenameLength is the number of runes of the
+// uploaded file name we keep for display.
+const maxOriginalFilenameLength = 255
+
+// imageUpload holds the data of an uploaded image while it
+// is being validated.
+type imageUpload struct {
+	image  *Image
+	data   []byte
+	width  int
+	height int
+	// decoded is set when a validation step had to decode the
+	// image, so it does not need to be decoded again.
+	decoded image.Image
+}
+
+type imageUploadValFunc func(*imageUpload) error
+
+func runImageUploadValFuncs(upload *imageUpload, fns ...imageUploadValFunc) error {
+	for _, fn := range fns {
+		if err := fn(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readImageUpload will read at most MaxImageBytes from r, and
+// return ErrImageTooLarge if there is more data than that.
+func readImageUpload(image *Image, r io.Reader) (*imageUpload, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	upload := imageUpload{
+		image: image,
+		data:  data,
+	}
+	err = runImageUploadValFuncs(&upload,
+		uploadNotEmpty,
+		uploadMaxBytes(MaxImageBytes),
+		uploadSniffContentType,
+		uploadDecodeConfig,
+		uploadMaxPixels(MaxImagePixels),
+		uploadProcessExif,
+		uploadSetFilename,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func uploadNotEmpty(upload *imageUpload) error {
+	if len(upload.data) == 0 {
+		return ErrImageEmpty
+	}
+	return nil
+}
+
+func uploadMaxBytes(n int) imageUploadValFunc {
+	return func(upload *imageUpload) error {
+		if len(upload.data) > n {
+			return ErrImageTooLarge
+		}
+		return nil
+	}
+}
+
+// uploadSniffContentType will look at the magic bytes of the
+// upload to determine its type, ignoring whatever the client
+// claimed it to be.
+func uploadSniffContentType(upload *imageUpload) error {
+	contentType := http.DetectContentType(upload.data)
+	if _, ok := imageExtensions[contentType]; !ok {
+		return ErrImageTypeInvalid
+	}
+	upload.image.ContentType = contentType
+	return nil
+}
+
+func uploadDecodeConfig(upload *imageUpload) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(upload.data))
+	if err != nil {
+		return ErrImageInvalid
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return ErrImageInvalid
+	}
+	upload.width = cfg.Width
+	upload.height = cfg.Height
+	upload.image.Width = cfg.Width
+	upload.image.Height = cfg.Height
+	return nil
+}
+
+func uploadMaxPixels(n int) imageUploadValFunc {
+	return func(upload *imageUpload) error {
+		if upload.width*upload.height > n {
+			return ErrImageTooManyPixels
+		}
+		return nil
+	}
+}
+
+// uploadProcessExif will read the Exif metadata of JPEG uploads,
+// rotate them upright according to their orientation and, unless
+// the uploader asked to keep it, strip the metadata from the data
+// we store. Metadata in other formats is rare and left as is.
+func uploadProcessExif(upload *imageUpload) error {
+	if upload.image.ContentType != "image/jpeg" {
+		return nil
+	}
+	orientation := 1
+	md, err := exif.Parse(upload.data)
+	if err == nil {
+		orientation = md.Orientation
+		upload.image.CameraMake = md.Make
+		upload.image.CameraModel = md.Model
+		upload.image.LensModel = strings.TrimSpace(md.LensMake + " " + md.LensModel)
+		if !md.DateTimeOriginal.IsZero() {
+			capturedAt := md.DateTimeOriginal
+			upload.image.CapturedAt = &capturedAt
+		}
+	}
+
+	if orientation == 1 {
+		if upload.image.KeepMetadata {
+			return nil
+		}
+		data, err := exif.Strip(upload.data)
+		if err != nil {
+			return ErrImageInvalid
+		}
+		upload.data = data
+		return nil
+	}
+
+	src, err := jpeg.Decode(bytes.NewReader(upload.data))
+	if err != nil {
+		return ErrImageInvalid
+	}
+	oriented := exif.Orient(src, orientation)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, oriented, &jpeg.Options{Quality: 92}); err != nil {
+		return err
+	}
+	// The encoder does not write any metadata, so there is nothing
+	// to strip unless we were asked to keep it.
+	data := buf.Bytes()
+	if upload.image.KeepMetadata {
+		data, err = exif.CopyMetadata(data, upload.data)
+		if err != nil {
+			return err
+		}
+	}
+	upload.data = data
+	upload.decoded = oriented
+	b := oriented.Bounds()
+	upload.width, upload.height = b.Dx(), b.Dy()
+	upload.image.Width, upload.image.Height = b.Dx(), b.Dy()
+	return nil
+}
+
+// uploadSetFilename will keep the name the client sent for display
+// only, and store the image under a random name so uploads can
+// never overwrite each other or escape the gallery directory.
+func uploadSetFilename(upload *imageUpload) error {
+	ext := imageExtensions[upload.image.ContentType]
+	original := sanitizeOriginalFilename(upload.image.Filename)
+	if original == "" {
+		original = "image" + ext
+	}
+	name, err := rand.ImageName()
+	if err != nil {
+		return err
+	}
+	upload.image.OriginalFilename = original
+	upload.image.Filename = name + ext
+	return nil
+}
+
+// sanitizeOriginalFilename will strip any directories and
+// control characters from the provided file name.
+func sanitizeOriginalFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxOriginalFilenameLength {
+		name = string(runes[:maxOriginalFilenameLength])
+	}
+	return name
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/monkjunior/goweb.learn/storage"
+	"golang.org/x/image/draw"
+)
+
+// Sizes of the resized variants we generate for every image.
+const (
+	ImageThumb  = "thumb"
+	ImageMedium = "medium"
+	ImageLarge  = "large"
+)
+
+// imageVariant describes a resized variant of an image. Images
+// are scaled down to fit in a MaxDim x MaxDim box, keeping their
+// aspect ratio.
+type imageVariant struct {
+	Size   string
+	MaxDim int
+}
+
+// imageVariants lists our variants from the smallest to the largest.
+var imageVariants = []imageVariant{
+	{Size: ImageThumb, MaxDim: 200},
+	{Size: ImageMedium, MaxDim: 800},
+	{Size: ImageLarge, MaxDim: 1600},
+}
+
+func findImageVariant(size string) (imageVariant, bool) {
+	for _, v := range imageVariants {
+		if v.Size == size {
+			return v, true
+		}
+	}
+	return imageVariant{}, false
+}
+
+// VariantPath is used to build the path used to reference the
+// resized variant of this image via a web request. If the image
+// already fits in the variant, the path of the original is returned.
+func (i *Image) VariantPath(size string) string {
+	v, ok := findImageVariant(size)
+	if !ok || i.fits(v) {
+		return i.Path()
+	}
+	temp := url.URL{
+		Path:     "/images/" + i.VariantKey(size),
+		RawQuery: i.shareQuery(),
+	}
+	return temp.String()
+}
+
+// VariantKey is used to build the key the resized variant of this
+// image is stored under in our storage.Store.
+func (i *Image) VariantKey(size string) string {
+	return path.Join(galleryKeyPrefix(i.GalleryID), size, i.variantFilename())
+}
+
+// Srcset returns the value of a srcset attribute listing every
+// variant of this image along with the original.
+func (i *Image) Srcset() string {
+	if i.Width <= 0 || i.Height <= 0 {
+		return ""
+	}
+	var candidates []string
+	for _, v := range imageVariants {
+		if i.fits(v) {
+			break
+		}
+		w, _ := scaledSize(i.Width, i.Height, v.MaxDim)
+		candidates = append(candidates, i.VariantPath(v.Size)+" "+strconv.Itoa(w)+"w")
+	}
+	candidates = append(candidates, i.Path()+" "+strconv.Itoa(i.Width)+"w")
+	return strings.Join(candidates, ", ")
+}
+
+// fits reports whether the image is already small enough that
+// the variant would not scale it down. Images with unknown
+// dimensions never fit.
+func (i *Image) fits(v imageVariant) bool {
+	if i.Width <= 0 || i.Height <= 0 {
+		return false
+	}
+	return i.Width <= v.MaxDim && i.Height <= v.MaxDim
+}
+
+// variantFilename returns the file name used by the variants of
+// this image. Variants are JPEGs unless the original may have
+// transparency, in which case they are PNGs.
+func (i *Image) variantFilename() string {
+	base := strings.TrimSuffix(i.Filename, path.Ext(i.Filename))
+	return base + i.variantExt()
+}
+
+func (i *Image) variantExt() string {
+	switch i.ContentType {
+	case "image/png", "image/gif":
+		return ".png"
+	default:
+		return ".jpg"
+	}
+}
+
+// scaledSize returns the dimensions of a w x h image scaled down
+// to fit in a maxDim x maxDim box.
+func scaledSize(w, h, maxDim int) (int, int) {
+	if w <= maxDim && h <= maxDim {
+		return w, h
+	}
+	if w >= h {
+		nh := h * maxDim / w
+		if nh < 1 {
+			nh = 1
+		}
+		return maxDim, nh
+	}
+	nw := w * maxDim / h
+	if nw < 1 {
+		nw = 1
+	}
+	return nw, maxDim
+}
+
+// generateVariants will store every variant of the image that
+// would scale it down. Failures are logged and skipped since
+// missing variants are generated again when first requested.
+func (is *imageService) generateVariants(img *Image, src image.Image) {
+	for _, v := range imageVariants {
+		if img.fits(v) {
+			continue
+		}
+		data, err := encodeVariant(img, src, v)
+		if err != nil {
+			log.Printf("images: generating %s variant of %s: %v\n", v.Size, img.Key(), err)
+			continue
+		}
+		if _, err := is.store.Put(img.VariantKey(v.Size), bytes.NewReader(data)); err != nil {
+			log.Printf("images: storing %s variant of %s: %v\n", v.Size, img.Key(), err)
+		}
+	}
+}
+
+// OpenVariant will open the resized variant of the image with the
+// size. If the variant is missing from the store it is generated
+// from the original first.
+func (is *imageService) OpenVariant(img *Image, size string) (io.ReadCloser, *storage.Object, error) {
+	v, ok := findImageVariant(size)
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	rc, obj, err := is.store.Get(img.VariantKey(v.Size))
+	if err != storage.ErrNotFound {
+		return rc, obj, err
+	}
+
+	orig, _, err := is.store.Get(img.Key())
+	if err == storage.ErrNotFound {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	src, _, err := image.Decode(orig)
+	orig.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := encodeVariant(img, src, v)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := img.VariantKey(v.Size)
+	if _, err := is.store.Put(key, bytes.NewReader(data)); err != nil {
+		// We can still serve what we generated this time.
+		log.Printf("images: storing %s variant of %s: %v\n", v.Size, img.Key(), err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), &storage.Object{
+		Key:  key,
+		Size: int64(len(data)),
+	}, nil
+}
+
+// ByVariantFilename will look up the image whose variants use the
+// provided file name.
+func (is *imageService) ByVariantFilename(galleryID uint, filename string) (*Image, error) {
+	base := strings.TrimSuffix(filename, path.Ext(filename))
+	for _, ext := range imageExtensions {
+		img, err := is.ByFilename(galleryID, base+ext)
+		if err == ErrNotFound || err == ErrFilenameInvalid {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if img.variantFilename() != filename {
+			return nil, ErrNotFound
+		}
+		return img, nil
+	}
+	return nil, ErrNotFound
+}
+
+// encodeVariant will scale src down to the variant and encode it
+// in the format used by the variants of img.
+func encodeVariant(img *Image, src image.Image, v imageVariant) ([]byte, error) {
+	b := src.Bounds()
+	w, h := scaledSize(b.Dx(), b.Dy(), v.MaxDim)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	var err error
+	if img.variantExt() == ".png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
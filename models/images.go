@@ -1,97 +1,442 @@
 package models
 
 import (
+	"bytes"
 	"fmt"
+	goimage "image"
 	"io"
+	"log"
 	"net/url"
-	"os"
-	"path/filepath"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/storage"
+	"gorm.io/gorm"
 )
 
 // Image is used to represent images stored in a Gallery.
-// Image is NOT stored in the database, and instead
-// references data stored on disk.
+// The image metadata is stored in the database while the
+// image data itself is kept in a storage.Store.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID uint `gorm:"not null;index;uniqueIndex:idx_images_gallery_filename"`
+	UserID    uint `gorm:"not null;index"`
+	// Filename is the randomly generated name the image is stored
+	// under, while OriginalFilename is the name it was uploaded
+	// with and is only used for display.
+	Filename         string `gorm:"not null;uniqueIndex:idx_images_gallery_filename"`
+	OriginalFilename string
+	ContentType      string
+	Size             int64
+	Width            int
+	Height           int
+	Caption          string
+	Position         int `gorm:"not null;default:0"`
+	// CapturedAt, CameraMake, CameraModel and LensModel are read
+	// from the Exif metadata of the uploaded photo, if any.
+	CapturedAt  *time.Time
+	CameraMake  string
+	CameraModel string
+	LensModel   string
+	// KeepMetadata is set when creating an image to keep the
+	// metadata, such as the GPS location, in the stored file.
+	KeepMetadata bool `gorm:"-"`
+	// ShareToken is set by the controllers when showing the image
+	// with the share link of its gallery. It is added to the paths
+	// of the image, which can only be seen with it.
+	ShareToken string `gorm:"-"`
+}
+
+// Camera returns a description of the camera the image was taken
+// with, or the empty string if unknown.
+func (i *Image) Camera() string {
+	if strings.HasPrefix(i.CameraModel, i.CameraMake) {
+		return i.CameraModel
+	}
+	return strings.TrimSpace(i.CameraMake + " " + i.CameraModel)
 }
 
 // Path is used to build the absolute path used to reference this image
 // via a web request.
 func (i *Image) Path() string {
 	temp := url.URL{
-		Path: "/" + i.RelativePath(),
+		Path:     "/images/" + i.Key(),
+		RawQuery: i.shareQuery(),
 	}
 	return temp.String()
 }
 
-// RelativePath is used to build the path to this image on our local
-// disk, relative to where our Go application is run from.
-func (i *Image) RelativePath() string {
-	// Convert the gallery ID to a string
-	galleryID := fmt.Sprintf("%v", i.GalleryID)
-	return filepath.ToSlash(filepath.Join("images", "galleries", galleryID, i.Filename))
+// shareQuery is the query added to the paths of the image, see
+// ShareToken.
+func (i *Image) shareQuery() string {
+	if i.ShareToken == "" {
+		return ""
+	}
+	return url.Values{"share": {i.ShareToken}}.Encode()
+}
+
+// Key is used to build the key this image is stored under
+// in our storage.Store.
+func (i *Image) Key() string {
+	return path.Join(galleryKeyPrefix(i.GalleryID), i.Filename)
+}
+
+// galleryKeyPrefix returns the key prefix shared by all images
+// of the gallery with the provided ID.
+func galleryKeyPrefix(galleryID uint) string {
+	return fmt.Sprintf("galleries/%v/", galleryID)
 }
 
 type ImageService interface {
-	Create(galleryID uint, r io.ReadCloser, filename string) error
+	// Create will validate the image data read from r, store it
+	// in the store and then create the image record. GalleryID,
+	// UserID and Filename are required.
+	Create(image *Image, r io.ReadCloser) error
+	ByID(id uint) (*Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
 	ByGalleryID(galleryID uint) ([]Image, error)
-	Delete(i *Image) error
+	Update(image *Image) error
+	// ByVariantFilename will look up the image whose variants use
+	// the provided file name.
+	ByVariantFilename(galleryID uint, filename string) (*Image, error)
+	// Open will open the original of the image. The image must be
+	// looked up first, so that images in the trash are not found,
+	// and the user authorized to see it, which also makes sure its
+	// gallery is not in the trash.
+	Open(image *Image) (io.ReadCloser, *storage.Object, error)
+	// OpenVariant will open the resized variant of the image with
+	// the size, generating it if it is missing. Like Open, the image
+	// must be looked up and authorized first.
+	OpenVariant(image *Image, size string) (io.ReadCloser, *storage.Object, error)
+	// Delete will move the image to the trash of the gallery owner.
+	// Its data and variants stay in the store until the trash is
+	// purged, see TrashService.
+	Delete(image *Image) error
+	// Backfill will create image records for every image found
+	// in the store that does not have one yet, and returns how many
+	// records were created.
+	Backfill() (int, error)
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+type ImageDB interface {
+	// Methods for querying images
+	ByID(id uint) (*Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+
+	// Methods for altering images
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(image *Image) error
+}
+
+func NewImageService(db *gorm.DB, store storage.Store) ImageService {
+	return &imageService{
+		ImageDB: &imageValidator{
+			ImageDB: &imageGorm{
+				db: db,
+			},
+		},
+		galleryDB: &galleryGorm{
+			db: db,
+		},
+		db:    db,
+		store: store,
+	}
 }
 
-type imageService struct{}
+type imageService struct {
+	ImageDB
+	galleryDB GalleryDB
+	db        *gorm.DB
+	store     storage.Store
+}
 
-func (i *imageService) Create(galleryID uint, r io.ReadCloser, filename string) error {
+func (is *imageService) Create(image *Image, r io.ReadCloser) error {
 	defer r.Close()
-	path, err := i.mkImagePath(galleryID)
+	upload, err := readImageUpload(image, r)
 	if err != nil {
 		return err
 	}
-	dst, err := os.Create(path + filename)
+	n, err := is.store.Put(image.Key(), bytes.NewReader(upload.data))
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(dst, r)
+	image.Size = n
+	err = is.ImageDB.Create(image)
 	if err != nil {
+		_ = is.store.Delete(image.Key())
 		return err
 	}
+	src := upload.decoded
+	if src == nil {
+		src, _, err = goimage.Decode(bytes.NewReader(upload.data))
+		if err != nil {
+			log.Printf("images: decoding %s: %v\n", image.Key(), err)
+			return nil
+		}
+	}
+	is.generateVariants(image, src)
 	return nil
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	strings, err := filepath.Glob(filepath.Join(path, "*"))
+func (is *imageService) Open(image *Image) (io.ReadCloser, *storage.Object, error) {
+	rc, obj, err := is.store.Get(image.Key())
+	if err == storage.ErrNotFound {
+		return nil, nil, ErrNotFound
+	}
+	return rc, obj, err
+}
+
+func (is *imageService) Backfill() (int, error) {
+	objects, err := is.store.List("galleries/")
 	if err != nil {
+		return 0, err
+	}
+	created := 0
+	for _, obj := range objects {
+		parts := strings.Split(obj.Key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+		galleryID, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		filename := parts[2]
+		referenced, err := is.referenced(uint(galleryID), filename)
+		if err != nil {
+			return created, err
+		}
+		if referenced {
+			continue
+		}
+		gallery, err := is.galleryDB.ByID(uint(galleryID))
+		if err == ErrNotFound {
+			// The gallery is gone, so nobody can see this image anyway.
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+		image := Image{
+			GalleryID: gallery.ID,
+			UserID:    gallery.UserID,
+			Filename:  filename,
+		}
+		if err := is.backfillImage(&image, obj); err != nil {
+			log.Printf("backfill: skipping %s: %v\n", obj.Key, err)
+			continue
+		}
+		created++
+	}
+	return created, nil
+}
+
+// referenced tells whether any image record points to the file,
+// including the records of images in the trash, whose files must be
+// left alone so they can be restored.
+func (is *imageService) referenced(galleryID uint, filename string) (bool, error) {
+	var count int64
+	err := is.db.Unscoped().Model(&Image{}).
+		Where("gallery_id = ? AND filename = ?", galleryID, filename).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// backfillImage will run the stored object through the same
+// validation as an upload, copy it to a generated file name
+// and create its record before removing the original object.
+func (is *imageService) backfillImage(image *Image, obj storage.Object) error {
+	rc, _, err := is.store.Get(obj.Key)
+	if err != nil {
+		return err
+	}
+	upload, err := readImageUpload(image, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	n, err := is.store.Put(image.Key(), bytes.NewReader(upload.data))
+	if err != nil {
+		return err
+	}
+	image.Size = n
+	image.CreatedAt = obj.ModTime
+	if err := is.ImageDB.Create(image); err != nil {
+		_ = is.store.Delete(image.Key())
+		return err
+	}
+	return is.store.Delete(obj.Key)
+}
+
+type imageValFunc func(*Image) error
+
+func runImageValFuncs(image *Image, fns ...imageValFunc) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type imageValidator struct {
+	ImageDB
+}
+
+// ByFilename will make sure the file name is one we could have
+// generated before looking it up, so user input never reaches
+// the store unchecked.
+func (iv *imageValidator) ByFilename(galleryID uint, filename string) (*Image, error) {
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+	if err := runImageValFuncs(&image, iv.galleryIDRequired, iv.filenameFormat); err != nil {
 		return nil, err
 	}
-	// Setup the Image slice we are returning
-	ret := make([]Image, len(strings))
-	for i, imgStr := range strings {
-		ret[i] = Image{
-			Filename:  filepath.Base(imgStr),
-			GalleryID: galleryID,
+	return iv.ImageDB.ByFilename(image.GalleryID, image.Filename)
+}
+
+// Create will validate the image and then create the image
+// record, placing it after the existing images of its gallery.
+func (iv *imageValidator) Create(image *Image) error {
+	err := runImageValFuncs(image,
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+		iv.filenameFormat,
+		iv.setDefaultPosition,
+	)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFuncs(image,
+		iv.idGreaterThan(0),
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+	)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+// Delete will delete the provided image record.
+func (iv *imageValidator) Delete(image *Image) error {
+	if err := runImageValFuncs(image, iv.idGreaterThan(0)); err != nil {
+		return err
+	}
+	return iv.ImageDB.Delete(image)
+}
+
+func (iv *imageValidator) galleryIDRequired(image *Image) error {
+	if image.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) userIDRequired(image *Image) error {
+	if image.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameRequired(image *Image) error {
+	if image.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameFormat(image *Image) error {
+	if !imageFilenameRegex.MatchString(image.Filename) {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
+func (iv *imageValidator) setDefaultPosition(image *Image) error {
+	if image.Position > 0 {
+		return nil
+	}
+	images, err := iv.ImageDB.ByGalleryID(image.GalleryID)
+	if err != nil {
+		return err
+	}
+	image.Position = len(images)
+	return nil
+}
+
+func (iv *imageValidator) idGreaterThan(n uint) imageValFunc {
+	return func(image *Image) error {
+		if image.ID <= n {
+			return ErrIDInvalid
 		}
+		return nil
 	}
-	return ret, nil
 }
 
-func (i *imageService) Delete(img *Image) error {
-	return os.Remove(img.RelativePath())
+type imageGorm struct {
+	db *gorm.DB
 }
 
-func (i *imageService) imagePath(galleryID uint) string {
-	return fmt.Sprintf("images/galleries/%v/", galleryID)
+// ByID will look up by the provided ID.
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	err := first(ig.db.Where("id = ?", id), &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
 }
 
-func (i *imageService) mkImagePath(galleryID uint) (string, error) {
-	galleryPath := i.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+// ByFilename will look up the image with the provided filename
+// in the gallery with the provided ID.
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	err := first(db, &image)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ByGalleryID will list all images of the gallery with the
+// provided ID, in display order.
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Where("gallery_id = ?", galleryID).Order("position, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
 	}
-	return galleryPath, nil
+	return images, nil
+}
+
+// Create will create the provided image and backfill data
+// like the ID, CreatedAt, and UpdatedAt fields.
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+// Update will update the provided image with all of the data
+// in the provided image object.
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+// Delete will soft delete the provided image record.
+func (ig *imageGorm) Delete(image *Image) error {
+	return ig.db.Delete(image).Error
 }
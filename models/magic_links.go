@@ -0,0 +1,151 @@
+package models
+
+import (
+	"github.com/monkjunior/goweb.learn/hash"
+	"github.com/monkjunior/goweb.learn/rand"
+	"gorm.io/gorm"
+)
+
+// Purposes of magic links, so a link can only be used for what it
+// was sent for.
+const (
+	magicLinkLogin    = "login"
+	magicLinkDeletion = "delete_account"
+)
+
+// magicLink is the token of a link we email to log a user in
+// without their password, or to confirm something they have no
+// password to confirm with. Email is the address it was sent to, so
+// a link stops working if the user changes their email in the
+// meantime.
+type magicLink struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	Purpose   string `gorm:"not null;default:login"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+}
+
+type magicLinkDB interface {
+	ByToken(token, purpose string) (*magicLink, error)
+	Create(ml *magicLink) error
+	Delete(id uint) error
+}
+
+func newMagicLinkValidator(mlDB magicLinkDB, hmac hash.HMAC) *magicLinkValidator {
+	return &magicLinkValidator{
+		magicLinkDB: mlDB,
+		hmac:        hmac,
+	}
+}
+
+type magicLinkValidator struct {
+	magicLinkDB
+	hmac hash.HMAC
+}
+
+func (mlv *magicLinkValidator) ByToken(token, purpose string) (*magicLink, error) {
+	ml := magicLink{Token: token}
+	err := runMagicLinkValFns(&ml, mlv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return mlv.magicLinkDB.ByToken(ml.TokenHash, purpose)
+}
+
+func (mlv *magicLinkValidator) Create(ml *magicLink) error {
+	err := runMagicLinkValFns(ml,
+		mlv.requireUserID,
+		mlv.defaultPurpose,
+		mlv.setTokenIfUnset,
+		mlv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return mlv.magicLinkDB.Create(ml)
+}
+
+func (mlv *magicLinkValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return mlv.magicLinkDB.Delete(id)
+}
+
+type magicLinkGorm struct {
+	db *gorm.DB
+}
+
+func (mlg *magicLinkGorm) ByToken(tokenHash, purpose string) (*magicLink, error) {
+	var ml magicLink
+	err := first(mlg.db.Where("token_hash = ? AND purpose = ?", tokenHash, purpose), &ml)
+	if err != nil {
+		return nil, err
+	}
+	return &ml, nil
+}
+
+func (mlg *magicLinkGorm) Create(ml *magicLink) error {
+	return mlg.db.Create(ml).Error
+}
+
+// Delete removes the link for good, so a used link cannot be
+// restored from the soft deleted rows.
+func (mlg *magicLinkGorm) Delete(id uint) error {
+	res := mlg.db.Unscoped().Delete(&magicLink{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func runMagicLinkValFns(ml *magicLink, fns ...magicLinkValFn) error {
+	for _, f := range fns {
+		err := f(ml)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type magicLinkValFn func(*magicLink) error
+
+func (mlv *magicLinkValidator) requireUserID(ml *magicLink) error {
+	if ml.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (mlv *magicLinkValidator) defaultPurpose(ml *magicLink) error {
+	if ml.Purpose == "" {
+		ml.Purpose = magicLinkLogin
+	}
+	return nil
+}
+
+func (mlv *magicLinkValidator) setTokenIfUnset(ml *magicLink) error {
+	if ml.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ml.Token = token
+	return nil
+}
+
+func (mlv *magicLinkValidator) hmacToken(ml *magicLink) error {
+	if ml.Token == "" {
+		return nil
+	}
+	ml.TokenHash = mlv.hmac.Hash(ml.Token)
+	return nil
+}
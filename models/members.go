@@ -0,0 +1,468 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/hash"
+	"github.com/monkjunior/goweb.learn/rand"
+	"gorm.io/gorm"
+)
+
+// Roles a user can have in a gallery. The user who created the
+// gallery is always an owner, other users get their role through
+// a Member record.
+const (
+	RoleViewer      = "viewer"
+	RoleContributor = "contributor"
+	RoleEditor      = "editor"
+	RoleOwner       = "owner"
+)
+
+// Permission is something a user can do with a gallery.
+type Permission int
+
+const (
+	// PermView allows seeing the gallery and its images.
+	PermView Permission = iota
+	// PermUpload allows adding images to the gallery.
+	PermUpload
+	// PermDeleteImages allows deleting images from the gallery.
+	PermDeleteImages
+	// PermRename allows changing the title of the gallery.
+	PermRename
+	// PermDeleteGallery allows deleting the gallery.
+	PermDeleteGallery
+	// PermManageMembers allows inviting, changing and removing
+	// members, and changing who the gallery is shared with.
+	PermManageMembers
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleViewer:      {PermView},
+	RoleContributor: {PermView, PermUpload},
+	RoleEditor:      {PermView, PermUpload, PermDeleteImages, PermRename},
+	RoleOwner: {PermView, PermUpload, PermDeleteImages, PermRename,
+		PermDeleteGallery, PermManageMembers},
+}
+
+// Roles lists the roles from the least to the most powerful.
+var Roles = []string{RoleViewer, RoleContributor, RoleEditor, RoleOwner}
+
+// RoleCan reports whether the role grants the permission. The
+// empty role, used for users who are not members, grants nothing.
+func RoleCan(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Member gives a user a role in a gallery they do not own.
+type Member struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;uniqueIndex:idx_members_gallery_user"`
+	UserID    uint   `gorm:"not null;uniqueIndex:idx_members_gallery_user;index"`
+	Role      string `gorm:"not null"`
+}
+
+// MemberService is used to manage who has access to galleries.
+type MemberService interface {
+	// Role returns the role of the user with the provided ID in
+	// the gallery, or the empty string if they have none.
+	Role(gallery *Gallery, userID uint) (string, error)
+
+	// Invite will create an invitation for the provided email
+	// address to join the gallery with the role, and return the
+	// token the invitee needs to accept it.
+	Invite(galleryID uint, email, role string) (string, error)
+	// AcceptInvite will make the user a member of the gallery
+	// they were invited to, and delete the invitation. The user
+	// must have the email address the invitation was sent to.
+	AcceptInvite(token string, user *User) (*Member, error)
+	// InviteByToken will look up the invitation with the provided
+	// token, to show what the user is about to accept.
+	InviteByToken(token string) (*Invite, error)
+	MemberDB
+}
+
+type MemberDB interface {
+	// Methods for querying members
+	ByID(id uint) (*Member, error)
+	ByGalleryID(galleryID uint) ([]Member, error)
+	ByUserID(userID uint) ([]Member, error)
+	ByGalleryAndUser(galleryID, userID uint) (*Member, error)
+
+	// Methods for altering members
+	Create(member *Member) error
+	Update(member *Member) error
+	Delete(id uint) error
+}
+
+func NewMemberService(db *gorm.DB, hmacKey string) MemberService {
+	return &memberService{
+		MemberDB: &memberValidator{
+			MemberDB: &memberGorm{
+				db: db,
+			},
+		},
+		inviteDB: newInviteValidator(&inviteGorm{
+			db: db,
+		}, hash.NewHMAC(hmacKey)),
+	}
+}
+
+type memberService struct {
+	MemberDB
+	inviteDB inviteDB
+}
+
+func (ms *memberService) Role(gallery *Gallery, userID uint) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+	if gallery.UserID == userID {
+		return RoleOwner, nil
+	}
+	member, err := ms.ByGalleryAndUser(gallery.ID, userID)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return member.Role, nil
+}
+
+func (ms *memberService) Invite(galleryID uint, email, role string) (string, error) {
+	inv := Invite{
+		GalleryID: galleryID,
+		Email:     email,
+		Role:      role,
+	}
+	if err := ms.inviteDB.Create(&inv); err != nil {
+		return "", err
+	}
+	return inv.Token, nil
+}
+
+func (ms *memberService) InviteByToken(token string) (*Invite, error) {
+	inv, err := ms.inviteDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrInviteInvalid
+		}
+		return nil, err
+	}
+	if time.Now().Sub(inv.CreatedAt) > (7 * 24 * time.Hour) {
+		return nil, ErrInviteInvalid
+	}
+	return inv, nil
+}
+
+func (ms *memberService) AcceptInvite(token string, user *User) (*Member, error) {
+	inv, err := ms.InviteByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Email != user.Email {
+		return nil, ErrInviteEmailMismatch
+	}
+	member, err := ms.ByGalleryAndUser(inv.GalleryID, user.ID)
+	switch err {
+	case nil:
+		member.Role = inv.Role
+		err = ms.Update(member)
+	case ErrNotFound:
+		member = &Member{
+			GalleryID: inv.GalleryID,
+			UserID:    user.ID,
+			Role:      inv.Role,
+		}
+		err = ms.Create(member)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = ms.inviteDB.Delete(inv.ID)
+	return member, nil
+}
+
+type memberValFunc func(*Member) error
+
+func runMemberValFuncs(member *Member, fns ...memberValFunc) error {
+	for _, fn := range fns {
+		if err := fn(member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memberValidator struct {
+	MemberDB
+}
+
+func (mv *memberValidator) Create(member *Member) error {
+	err := runMemberValFuncs(member,
+		mv.galleryIDRequired,
+		mv.userIDRequired,
+		mv.roleValid,
+	)
+	if err != nil {
+		return err
+	}
+	return mv.MemberDB.Create(member)
+}
+
+func (mv *memberValidator) Update(member *Member) error {
+	err := runMemberValFuncs(member,
+		mv.galleryIDRequired,
+		mv.userIDRequired,
+		mv.roleValid,
+	)
+	if err != nil {
+		return err
+	}
+	return mv.MemberDB.Update(member)
+}
+
+// Delete will delete the member with the provided ID
+func (mv *memberValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return mv.MemberDB.Delete(id)
+}
+
+func (mv *memberValidator) galleryIDRequired(member *Member) error {
+	if member.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (mv *memberValidator) userIDRequired(member *Member) error {
+	if member.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (mv *memberValidator) roleValid(member *Member) error {
+	if _, ok := rolePermissions[member.Role]; !ok {
+		return ErrRoleInvalid
+	}
+	return nil
+}
+
+type memberGorm struct {
+	db *gorm.DB
+}
+
+// ByID will look up by the provided ID.
+func (mg *memberGorm) ByID(id uint) (*Member, error) {
+	var member Member
+	err := first(mg.db.Where("id = ?", id), &member)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// ByGalleryID will list all members of the gallery with the provided ID.
+func (mg *memberGorm) ByGalleryID(galleryID uint) ([]Member, error) {
+	var members []Member
+	if err := mg.db.Where("gallery_id = ?", galleryID).Order("id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// ByUserID will list all the memberships of the user with the provided ID.
+func (mg *memberGorm) ByUserID(userID uint) ([]Member, error) {
+	var members []Member
+	if err := mg.db.Where("user_id = ?", userID).Order("id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// ByGalleryAndUser will look up the membership of the user in the gallery.
+func (mg *memberGorm) ByGalleryAndUser(galleryID, userID uint) (*Member, error) {
+	var member Member
+	db := mg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID)
+	err := first(db, &member)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Create will create the provided member and backfill data
+// like the ID, CreatedAt, and UpdatedAt fields.
+func (mg *memberGorm) Create(member *Member) error {
+	return mg.db.Create(member).Error
+}
+
+// Update will update the provided member with all of the data
+// in the provided member object.
+func (mg *memberGorm) Update(member *Member) error {
+	return mg.db.Save(member).Error
+}
+
+// Delete will delete the member with the provided ID. Members
+// are removed for good so they can be invited again later.
+func (mg *memberGorm) Delete(id uint) error {
+	member := Member{
+		Model: gorm.Model{
+			ID: id,
+		},
+	}
+	return mg.db.Unscoped().Delete(&member).Error
+}
+
+// Invite is an invitation sent by email to join a gallery.
+type Invite struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	Role      string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+}
+
+type inviteDB interface {
+	ByToken(token string) (*Invite, error)
+	Create(inv *Invite) error
+	Delete(id uint) error
+}
+
+func newInviteValidator(inviteDB inviteDB, hmac hash.HMAC) *inviteValidator {
+	return &inviteValidator{
+		inviteDB: inviteDB,
+		hmac:     hmac,
+	}
+}
+
+type inviteValidator struct {
+	inviteDB
+	hmac hash.HMAC
+}
+
+func (iv *inviteValidator) ByToken(token string) (*Invite, error) {
+	inv := Invite{Token: token}
+	err := runInviteValFns(&inv, iv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return iv.inviteDB.ByToken(inv.TokenHash)
+}
+
+func (iv *inviteValidator) Create(inv *Invite) error {
+	err := runInviteValFns(inv,
+		iv.requireGalleryID,
+		iv.emailNormalize,
+		iv.requireEmail,
+		iv.roleValid,
+		iv.setTokenIfUnset,
+		iv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return iv.inviteDB.Create(inv)
+}
+
+func (iv *inviteValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.inviteDB.Delete(id)
+}
+
+type inviteGorm struct {
+	db *gorm.DB
+}
+
+func (ig *inviteGorm) ByToken(tokenHash string) (*Invite, error) {
+	var inv Invite
+	err := first(ig.db.Where("token_hash = ?", tokenHash), &inv)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (ig *inviteGorm) Create(inv *Invite) error {
+	return ig.db.Create(inv).Error
+}
+
+func (ig *inviteGorm) Delete(id uint) error {
+	inv := Invite{
+		Model: gorm.Model{
+			ID: id,
+		},
+	}
+	return ig.db.Delete(&inv).Error
+}
+
+func runInviteValFns(inv *Invite, fns ...inviteValFn) error {
+	for _, f := range fns {
+		err := f(inv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type inviteValFn func(*Invite) error
+
+func (iv *inviteValidator) requireGalleryID(inv *Invite) error {
+	if inv.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (iv *inviteValidator) emailNormalize(inv *Invite) error {
+	inv.Email = strings.TrimSpace(strings.ToLower(inv.Email))
+	return nil
+}
+
+func (iv *inviteValidator) requireEmail(inv *Invite) error {
+	if inv.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (iv *inviteValidator) roleValid(inv *Invite) error {
+	if _, ok := rolePermissions[inv.Role]; !ok {
+		return ErrRoleInvalid
+	}
+	return nil
+}
+
+func (iv *inviteValidator) setTokenIfUnset(inv *Invite) error {
+	if inv.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	inv.Token = token
+	return nil
+}
+
+func (iv *inviteValidator) hmacToken(inv *Invite) error {
+	if inv.Token == "" {
+		return nil
+	}
+	inv.TokenHash = iv.hmac.Hash(inv.Token)
+	return nil
+}
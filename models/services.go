@@ -5,16 +5,25 @@ import (
 	"os"
 	"time"
 
+	"github.com/monkjunior/goweb.learn/password"
+	"github.com/monkjunior/goweb.learn/storage"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
 type Services struct {
-	db      *gorm.DB
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
+	db        *gorm.DB
+	Gallery   GalleryService
+	User      UserService
+	Image     ImageService
+	Member    MemberService
+	APIToken  APITokenService
+	Session   SessionService
+	TwoFactor TwoFactorService
+	Identity  IdentityService
+	Account   AccountService
+	Trash     TrashService
 }
 
 type ServicesConfig func(services *Services) error
@@ -40,9 +49,9 @@ func WithGorm(connInfo string) ServicesConfig {
 	}
 }
 
-func WithUser(hmacKey, pepper string) ServicesConfig {
+func WithUser(hmacKey string, hasher *password.Hasher, pwPolicy *password.Policy) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, hmacKey, pepper)
+		s.User = NewUserService(s.db, hmacKey, hasher, pwPolicy)
 		return nil
 	}
 }
@@ -54,9 +63,61 @@ func WithGallery() ServicesConfig {
 	}
 }
 
-func WithImage() ServicesConfig {
+func WithImage(store storage.Store) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.db, store)
+		return nil
+	}
+}
+
+func WithMember(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Member = NewMemberService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithAPIToken needs WithUser to be run first.
+func WithAPIToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, s.User, hmacKey)
+		return nil
+	}
+}
+
+// WithSession needs WithUser to be run first.
+func WithSession(hmacKey string, lifetime SessionLifetime) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, s.User, hmacKey, lifetime)
+		return nil
+	}
+}
+
+// WithTwoFactor needs WithUser to be run first.
+func WithTwoFactor(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.TwoFactor = NewTwoFactorService(s.db, s.User, hmacKey)
+		return nil
+	}
+}
+
+func WithIdentity() ServicesConfig {
+	return func(s *Services) error {
+		s.Identity = NewIdentityService(s.db)
+		return nil
+	}
+}
+
+func WithAccount(store storage.Store) ServicesConfig {
+	return func(s *Services) error {
+		s.Account = NewAccountService(s.db, store)
+		return nil
+	}
+}
+
+func WithTrash(store storage.Store, retention time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.Trash = NewTrashService(s.db, store, retention)
 		return nil
 	}
 }
@@ -82,14 +143,14 @@ func (s *Services) Close() error {
 
 // DestructiveReset drops all tables and rebuilds them
 func (s *Services) DestructiveReset() error {
-	err := s.db.Migrator().DropTable(&User{}, &Gallery{})
+	err := s.db.Migrator().DropTable(&User{}, &Gallery{}, &Image{}, &Member{}, &Invite{}, &APIToken{}, &Session{}, &RecoveryCode{}, &Identity{})
 	if err != nil {
 		return err
 	}
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{})
+	return s.db.AutoMigrate(&User{}, &Gallery{}, &Image{}, &pwReset{}, &emailVerification{}, &magicLink{}, &Member{}, &Invite{}, &APIToken{}, &Session{}, &RecoveryCode{}, &Identity{})
 }
 
 // AutoMigrate will attempt to automatically migrate all table
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{})
+	return s.db.AutoMigrate(&User{}, &Gallery{}, &Image{}, &pwReset{}, &emailVerification{}, &magicLink{}, &Member{}, &Invite{}, &APIToken{}, &Session{}, &RecoveryCode{}, &Identity{})
 }
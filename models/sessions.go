@@ -0,0 +1,382 @@
+package models
+
+import (
+	"time"
+
+	"github.com/monkjunior/goweb.learn/hash"
+	"github.com/monkjunior/goweb.learn/rand"
+	"gorm.io/gorm"
+)
+
+// SessionLifetime sets how long sessions last.
+type SessionLifetime struct {
+	// Absolute is how long a session lasts after login, no
+	// matter how often it is used.
+	Absolute time.Duration
+	// Idle is how long a session lasts without being used.
+	Idle time.Duration
+}
+
+// DefaultSessionLifetime is used for the fields of a
+// SessionLifetime that are not set.
+var DefaultSessionLifetime = SessionLifetime{
+	Absolute: 30 * 24 * time.Hour,
+	Idle:     3 * 24 * time.Hour,
+}
+
+const (
+	// sessionSeenEvery is how often we record that a session was
+	// used, so we do not write to the database on every request.
+	sessionSeenEvery = time.Minute
+	// maxUserAgentLength keeps huge user agents out of the table.
+	maxUserAgentLength = 512
+	// PendingSessionDuration is how long users have to enter their
+	// second factor after their password.
+	PendingSessionDuration = 10 * time.Minute
+	// maxPendingAttempts is how many wrong codes can be entered
+	// before the pending session is deleted and users have to enter
+	// their password again.
+	maxPendingAttempts = 5
+)
+
+// Session is a logged in device. Every login creates a session,
+// so users can be logged in on several devices at once and log
+// them out one by one.
+type Session struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;uniqueIndex"`
+	IP         string
+	UserAgent  string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null"`
+	// Pending sessions are created once the password of a user
+	// with two-factor authentication is verified. They do not log
+	// the user in until the second factor is verified as well.
+	Pending        bool `gorm:"not null;default:false"`
+	FailedAttempts int  `gorm:"not null;default:0"`
+	// IdleExpiresAt is when the session expires if it is not used
+	// again, set by the SessionService.
+	IdleExpiresAt time.Time `gorm:"-"`
+	// Renewed is set by Authenticate when it pushed IdleExpiresAt
+	// back, so the cookie should be renewed as well.
+	Renewed bool `gorm:"-"`
+}
+
+// CookieExpiresAt returns when the cookie holding the session
+// should expire.
+func (s *Session) CookieExpiresAt() time.Time {
+	if s.IdleExpiresAt.IsZero() || s.ExpiresAt.Before(s.IdleExpiresAt) {
+		return s.ExpiresAt
+	}
+	return s.IdleExpiresAt
+}
+
+// SessionService is used to manage the sessions of users.
+type SessionService interface {
+	// Authenticate will look up the session with the provided
+	// token and the user it belongs to. ErrNotFound is returned
+	// if the session does not exist, or has expired because it is
+	// too old or was not used for too long. ip is recorded as the
+	// last address the session was seen from.
+	Authenticate(token, ip string) (*User, *Session, error)
+	// Pending will look up the pending session with the provided
+	// token and the user it belongs to. ErrNotFound is returned if
+	// the session does not exist, is not pending or has expired.
+	Pending(token string) (*User, *Session, error)
+	// PendingFailed records a wrong second factor entered for the
+	// pending session, and deletes it after too many.
+	PendingFailed(session *Session) error
+	SessionDB
+}
+
+type SessionDB interface {
+	// Methods for querying sessions
+	ByID(id uint) (*Session, error)
+	ByToken(token string) (*Session, error)
+	// ByUserID returns the sessions of the user that have not
+	// reached their absolute expiry, the most recently seen first.
+	ByUserID(userID uint) ([]Session, error)
+
+	// Methods for altering sessions
+	Create(session *Session) error
+	Seen(id uint, at time.Time, ip string) error
+	IncrementFailedAttempts(id uint) error
+	Delete(id uint) error
+	// DeleteByUserID will delete every session of the user
+	// except the one with the ID keep, which may be 0.
+	DeleteByUserID(userID, keep uint) error
+}
+
+func NewSessionService(db *gorm.DB, us UserService, hmacKey string, lifetime SessionLifetime) SessionService {
+	if lifetime.Absolute <= 0 {
+		lifetime.Absolute = DefaultSessionLifetime.Absolute
+	}
+	if lifetime.Idle <= 0 {
+		lifetime.Idle = DefaultSessionLifetime.Idle
+	}
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{
+				db: db,
+			},
+			hmac:     hash.NewHMAC(hmacKey),
+			lifetime: lifetime,
+		},
+		us:       us,
+		lifetime: lifetime,
+	}
+}
+
+type sessionService struct {
+	SessionDB
+	us       UserService
+	lifetime SessionLifetime
+}
+
+func (ss *sessionService) Create(session *Session) error {
+	if err := ss.SessionDB.Create(session); err != nil {
+		return err
+	}
+	session.IdleExpiresAt = session.LastSeenAt.Add(ss.lifetime.Idle)
+	return nil
+}
+
+// ByUserID will also leave out the sessions that were not used
+// for too long.
+func (ss *sessionService) ByUserID(userID uint) ([]Session, error) {
+	sessions, err := ss.SessionDB.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ret := sessions[:0]
+	for _, s := range sessions {
+		s.IdleExpiresAt = s.LastSeenAt.Add(ss.lifetime.Idle)
+		if now.After(s.IdleExpiresAt) {
+			continue
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func (ss *sessionService) Authenticate(token, ip string) (*User, *Session, error) {
+	session, err := ss.ByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	session.Token = token
+	if session.Pending {
+		return nil, nil, ErrNotFound
+	}
+	now := time.Now()
+	if now.After(session.ExpiresAt) || now.Sub(session.LastSeenAt) > ss.lifetime.Idle {
+		_ = ss.Delete(session.ID)
+		return nil, nil, ErrNotFound
+	}
+	user, err := ss.us.ByID(session.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if now.Sub(session.LastSeenAt) > sessionSeenEvery || session.IP != ip {
+		if err := ss.Seen(session.ID, now, ip); err != nil {
+			return nil, nil, err
+		}
+		session.LastSeenAt = now
+		session.IP = ip
+		session.Renewed = true
+	}
+	session.IdleExpiresAt = session.LastSeenAt.Add(ss.lifetime.Idle)
+	return user, session, nil
+}
+
+func (ss *sessionService) Pending(token string) (*User, *Session, error) {
+	session, err := ss.ByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !session.Pending || time.Now().After(session.ExpiresAt) {
+		return nil, nil, ErrNotFound
+	}
+	user, err := ss.us.ByID(session.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	session.Token = token
+	return user, session, nil
+}
+
+func (ss *sessionService) PendingFailed(session *Session) error {
+	if session.FailedAttempts+1 >= maxPendingAttempts {
+		return ss.Delete(session.ID)
+	}
+	session.FailedAttempts++
+	return ss.IncrementFailedAttempts(session.ID)
+}
+
+type sessionValFunc func(*Session) error
+
+func runSessionValFuncs(session *Session, fns ...sessionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac     hash.HMAC
+	lifetime SessionLifetime
+}
+
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	s := Session{Token: token}
+	if err := runSessionValFuncs(&s, sv.hmacToken); err != nil {
+		return nil, err
+	}
+	return sv.SessionDB.ByToken(s.TokenHash)
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFuncs(session,
+		sv.userIDRequired,
+		sv.setTokenIfUnset,
+		sv.hmacToken,
+		sv.truncateUserAgent,
+		sv.setDefaultTimes,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID, keep uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return sv.SessionDB.DeleteByUserID(userID, keep)
+}
+
+func (sv *sessionValidator) userIDRequired(s *Session) error {
+	if s.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(s *Session) error {
+	if s.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	s.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(s *Session) error {
+	if s.Token == "" {
+		return nil
+	}
+	s.TokenHash = sv.hmac.Hash(s.Token)
+	return nil
+}
+
+func (sv *sessionValidator) truncateUserAgent(s *Session) error {
+	if len(s.UserAgent) > maxUserAgentLength {
+		s.UserAgent = s.UserAgent[:maxUserAgentLength]
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setDefaultTimes(s *Session) error {
+	now := time.Now()
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = now
+	}
+	if s.ExpiresAt.IsZero() {
+		if s.Pending {
+			s.ExpiresAt = now.Add(PendingSessionDuration)
+		} else {
+			s.ExpiresAt = now.Add(sv.lifetime.Absolute)
+		}
+	}
+	return nil
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *sessionGorm) ByID(id uint) (*Session, error) {
+	var s Session
+	err := first(sg.db.Where("id = ?", id), &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var s Session
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ? AND expires_at > ? AND NOT pending", userID, time.Now()).
+		Order("last_seen_at desc").Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Seen(id uint, at time.Time, ip string) error {
+	return sg.db.Model(&Session{}).Where("id = ?", id).
+		UpdateColumns(map[string]interface{}{
+			"last_seen_at": at,
+			"ip":           ip,
+		}).Error
+}
+
+func (sg *sessionGorm) IncrementFailedAttempts(id uint) error {
+	return sg.db.Model(&Session{}).Where("id = ?", id).
+		UpdateColumn("failed_attempts", gorm.Expr("failed_attempts + 1")).Error
+}
+
+// Delete will remove the session for good, so that its token can
+// never be used again.
+func (sg *sessionGorm) Delete(id uint) error {
+	return sg.db.Unscoped().Delete(&Session{}, id).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID, keep uint) error {
+	return sg.db.Unscoped().Where("user_id = ? AND id <> ?", userID, keep).
+		Delete(&Session{}).Error
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/storage"
+	"gorm.io/gorm"
+)
+
+// TrashService is used to list and restore the galleries and images
+// users deleted, until they are purged for good.
+type TrashService interface {
+	// Galleries lists the deleted galleries of the user, most
+	// recently deleted first.
+	Galleries(userID uint) ([]Gallery, error)
+	// Images lists the images deleted from the galleries of the
+	// user that are not deleted themselves, most recently deleted
+	// first.
+	Images(userID uint) ([]Image, error)
+	// RestoreGallery and RestoreImage return ErrNotFound unless the
+	// gallery or image is in the trash of the user.
+	RestoreGallery(userID, id uint) error
+	RestoreImage(userID, id uint) error
+	// Retention is how long galleries and images stay in the trash.
+	Retention() time.Duration
+	// Purge will delete for good the galleries and images deleted
+	// longer than Retention ago, along with their files, and
+	// returns how many were deleted.
+	Purge() (int, error)
+}
+
+func NewTrashService(db *gorm.DB, store storage.Store, retention time.Duration) TrashService {
+	return &trashService{
+		db:        db,
+		store:     store,
+		retention: retention,
+	}
+}
+
+type trashService struct {
+	db        *gorm.DB
+	store     storage.Store
+	retention time.Duration
+}
+
+func (ts *trashService) Galleries(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := ts.db.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at DESC").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (ts *trashService) Images(userID uint) ([]Image, error) {
+	var images []Image
+	err := ts.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND gallery_id IN (?)", ts.ownedGalleries(userID)).
+		Order("deleted_at DESC").
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// ownedGalleries is the subquery of the IDs of the galleries of the
+// user that are not deleted.
+func (ts *trashService) ownedGalleries(userID uint) *gorm.DB {
+	return ts.db.Model(&Gallery{}).Select("id").Where("user_id = ?", userID)
+}
+
+func (ts *trashService) RestoreGallery(userID, id uint) error {
+	res := ts.db.Unscoped().Model(&Gallery{}).
+		Where("id = ? AND user_id = ? AND deleted_at IS NOT NULL", id, userID).
+		Update("deleted_at", nil)
+	return restored(res)
+}
+
+func (ts *trashService) RestoreImage(userID, id uint) error {
+	res := ts.db.Unscoped().Model(&Image{}).
+		Where("id = ? AND deleted_at IS NOT NULL AND gallery_id IN (?)", id, ts.ownedGalleries(userID)).
+		Update("deleted_at", nil)
+	return restored(res)
+}
+
+// restored returns ErrNotFound if the restore did not find the row.
+func restored(res *gorm.DB) error {
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (ts *trashService) Retention() time.Duration {
+	return ts.retention
+}
+
+func (ts *trashService) Purge() (int, error) {
+	cutoff := time.Now().Add(-ts.retention)
+	var galleryIDs []uint
+	var images []Image
+	err := ts.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&Gallery{}).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+			Pluck("id", &galleryIDs).Error
+		if err != nil {
+			return err
+		}
+		if err := deleteGalleries(tx, galleryIDs); err != nil {
+			return err
+		}
+		err = tx.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).Find(&images).Error
+		if err != nil {
+			return err
+		}
+		return deleteImages(tx, images)
+	})
+	if err != nil {
+		return 0, err
+	}
+	removeGalleryFiles(ts.store, galleryIDs)
+	removeImageFiles(ts.store, images)
+	return len(galleryIDs) + len(images), nil
+}
+
+// deleteGalleries will delete the rows of the galleries with the
+// IDs for good, along with their images, members and invites.
+func deleteGalleries(tx *gorm.DB, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, model := range []interface{}{&Image{}, &Member{}, &Invite{}} {
+		if err := tx.Unscoped().Where("gallery_id IN ?", ids).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Unscoped().Where("id IN ?", ids).Delete(&Gallery{}).Error
+}
+
+// deleteImages will delete the rows of the images for good.
+func deleteImages(tx *gorm.DB, images []Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(images))
+	for i, img := range images {
+		ids[i] = img.ID
+	}
+	return tx.Unscoped().Where("id IN ?", ids).Delete(&Image{}).Error
+}
+
+// removeGalleryFiles will remove every file of the galleries with
+// the IDs from the store. Rows cannot be brought back once their
+// files are gone, so this is done after deleting them, and errors
+// are only logged.
+func removeGalleryFiles(store storage.Store, ids []uint) {
+	for _, id := range ids {
+		objects, err := store.List(galleryKeyPrefix(id))
+		if err != nil {
+			log.Printf("models: listing files of gallery %d: %v\n", id, err)
+			continue
+		}
+		for _, obj := range objects {
+			if err := store.Delete(obj.Key); err != nil {
+				log.Printf("models: deleting %s: %v\n", obj.Key, err)
+			}
+		}
+	}
+}
+
+// removeImageFiles will remove the images and their variants from
+// the store, like removeGalleryFiles.
+func removeImageFiles(store storage.Store, images []Image) {
+	for _, img := range images {
+		keys := []string{img.Key()}
+		for _, v := range imageVariants {
+			keys = append(keys, img.VariantKey(v.Size))
+		}
+		for _, key := range keys {
+			if err := store.Delete(key); err != nil {
+				log.Printf("models: deleting %s: %v\n", key, err)
+			}
+		}
+	}
+}
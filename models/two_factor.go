@@ -0,0 +1,211 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/hash"
+	"github.com/monkjunior/goweb.learn/rand"
+	"github.com/monkjunior/goweb.learn/totp"
+	"gorm.io/gorm"
+)
+
+// RecoveryCodeCount is how many recovery codes users get.
+const RecoveryCodeCount = 10
+
+// RecoveryCode lets a user log in once without their
+// authenticator app.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index:idx_recovery_codes_user_code"`
+	CodeHash string `gorm:"not null;index:idx_recovery_codes_user_code"`
+}
+
+// TwoFactorService is used to manage the second factor users can
+// be asked for after their password: the codes of an authenticator
+// app (TOTP), or single-use recovery codes.
+type TwoFactorService interface {
+	// Enroll will generate a new TOTP secret for the user and
+	// store it. Two-factor authentication is not enabled until a
+	// code generated with the secret is passed to Enable.
+	Enroll(user *User) error
+	// Enable will check the code against the secret set by Enroll
+	// and enable two-factor authentication. It returns new
+	// recovery codes, which are only ever shown this once.
+	Enable(user *User, code string) ([]string, error)
+	// Disable will turn two-factor authentication off, once code
+	// has been verified.
+	Disable(user *User, code string) error
+	// Verify will check a TOTP or a recovery code. Codes can only
+	// be used once. ErrCodeInvalid is returned if it does not match.
+	Verify(user *User, code string) error
+	// RegenerateRecoveryCodes will replace the recovery codes of
+	// the user, once code has been verified.
+	RegenerateRecoveryCodes(user *User, code string) ([]string, error)
+	// RecoveryCodesLeft returns how many unused recovery codes the
+	// user has.
+	RecoveryCodesLeft(userID uint) (int, error)
+}
+
+func NewTwoFactorService(db *gorm.DB, us UserService, hmacKey string) TwoFactorService {
+	return &twoFactorService{
+		us:   us,
+		rcg:  &recoveryCodeGorm{db: db},
+		hmac: hash.NewHMAC(hmacKey),
+	}
+}
+
+type twoFactorService struct {
+	us   UserService
+	rcg  *recoveryCodeGorm
+	hmac hash.HMAC
+}
+
+func (tfs *twoFactorService) Enroll(user *User) error {
+	if user.TOTPEnabled {
+		return ErrTwoFactorEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = secret
+	return tfs.us.Update(user)
+}
+
+func (tfs *twoFactorService) Enable(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err := tfs.verifyTOTP(user, code); err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	if err := tfs.us.Update(user); err != nil {
+		return nil, err
+	}
+	return tfs.newRecoveryCodes(user.ID)
+}
+
+func (tfs *twoFactorService) Disable(user *User, code string) error {
+	if err := tfs.Verify(user, code); err != nil {
+		return err
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	if err := tfs.us.Update(user); err != nil {
+		return err
+	}
+	return tfs.rcg.DeleteByUserID(user.ID)
+}
+
+func (tfs *twoFactorService) Verify(user *User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return tfs.verifyTOTP(user, code)
+	}
+	rc, err := tfs.rcg.ByHash(user.ID, tfs.hmac.Hash(normalizeRecoveryCode(code)))
+	if err == ErrNotFound {
+		return ErrCodeInvalid
+	}
+	if err != nil {
+		return err
+	}
+	return tfs.rcg.Delete(rc.ID)
+}
+
+func (tfs *twoFactorService) RegenerateRecoveryCodes(user *User, code string) ([]string, error) {
+	if err := tfs.Verify(user, code); err != nil {
+		return nil, err
+	}
+	return tfs.newRecoveryCodes(user.ID)
+}
+
+func (tfs *twoFactorService) RecoveryCodesLeft(userID uint) (int, error) {
+	return tfs.rcg.CountByUserID(userID)
+}
+
+// verifyTOTP will check the code against the TOTP secret of the
+// user, refusing codes from time steps that were already used.
+func (tfs *twoFactorService) verifyTOTP(user *User, code string) error {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok || step <= user.TOTPLastStep {
+		return ErrCodeInvalid
+	}
+	user.TOTPLastStep = step
+	return tfs.us.Update(user)
+}
+
+// newRecoveryCodes will replace the recovery codes of the user and
+// return the new ones.
+func (tfs *twoFactorService) newRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	rcs := make([]RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		code, err := rand.RecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		rcs[i] = RecoveryCode{
+			UserID:   userID,
+			CodeHash: tfs.hmac.Hash(normalizeRecoveryCode(code)),
+		}
+	}
+	if err := tfs.rcg.Replace(userID, rcs); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode lets users type recovery codes without
+// the dash, or in upper case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+func (rcg *recoveryCodeGorm) ByHash(userID uint, codeHash string) (*RecoveryCode, error) {
+	var rc RecoveryCode
+	err := first(rcg.db.Where("user_id = ? AND code_hash = ?", userID, codeHash), &rc)
+	if err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+func (rcg *recoveryCodeGorm) CountByUserID(userID uint) (int, error) {
+	var n int64
+	err := rcg.db.Model(&RecoveryCode{}).Where("user_id = ?", userID).Count(&n).Error
+	return int(n), err
+}
+
+// Replace will delete the recovery codes of the user and create
+// rcs instead, in a single transaction.
+func (rcg *recoveryCodeGorm) Replace(userID uint, rcs []RecoveryCode) error {
+	return rcg.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&rcs).Error
+	})
+}
+
+func (rcg *recoveryCodeGorm) Delete(id uint) error {
+	return rcg.db.Unscoped().Delete(&RecoveryCode{}, id).Error
+}
+
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
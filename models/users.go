@@ -2,14 +2,15 @@ package models
 
 import (
 	"errors"
+	"log"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/monkjunior/goweb.learn/hash"
+	"github.com/monkjunior/goweb.learn/password"
 	"github.com/monkjunior/goweb.learn/rand"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -25,7 +26,53 @@ type User struct {
 	PasswordHash string `gorm:"not null"`
 	Remember     string `gorm:"-"`
 	RememberHash string `gorm:"not null;uniqueIndex"`
-}
+	// KeepImageMetadata keeps the Exif metadata, including the
+	// GPS location, in the photos uploaded by this user.
+	KeepImageMetadata bool `gorm:"not null;default:false"`
+	// TOTPSecret is the secret shared with the authenticator app
+	// of the user. It is set when they start enrolling, and
+	// TOTPEnabled once they proved their app works.
+	TOTPSecret  string
+	TOTPEnabled bool `gorm:"not null;default:false"`
+	// TOTPLastStep is the time step of the last code used, so that
+	// codes cannot be used twice.
+	TOTPLastStep int64 `gorm:"not null;default:0"`
+	// VerifiedAt is when the user proved they own their email
+	// address. It is nil until then, and reset when the email
+	// address changes.
+	VerifiedAt *time.Time
+	// DeleteAt is when the account will be deleted for good, if
+	// the user asked for it. It is nil otherwise.
+	DeleteAt *time.Time `gorm:"index"`
+}
+
+// HasPassword reports whether the user can log in with a password.
+// Users who signed up with an identity provider have none until
+// they reset it.
+func (u *User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
+// Verified reports whether the user verified their email address.
+func (u *User) Verified() bool {
+	return u.VerifiedAt != nil
+}
+
+// MagicLinkDuration is how long the links we email to log in
+// without a password work for.
+const MagicLinkDuration = 15 * time.Minute
+
+// DeletionLinkDuration is how long the links we email to confirm
+// the deletion of an account work for.
+const DeletionLinkDuration = time.Hour
+
+// AccountDeletionGracePeriod is how long users have to change their
+// mind after asking for their account to be deleted.
+const AccountDeletionGracePeriod = 14 * 24 * time.Hour
+
+// EmailVerificationDuration is how long the links we email to verify
+// an email address work for.
+const EmailVerificationDuration = 48 * time.Hour
 
 // UserDB is used to interact with the users database.
 //
@@ -45,6 +92,9 @@ type UserDB interface {
 
 	// Methods for altering users
 	Create(user *User) error
+	// CreatePasswordless will create a user who logs in another
+	// way, eg: with an identity provider.
+	CreatePasswordless(user *User) error
 	Update(user *User) error
 	Delete(ID uint) error
 }
@@ -55,61 +105,156 @@ type UserService interface {
 	// Authenticate will verify the provided email and password and
 	// password are correct. If they are correct, the user corresponding
 	// to that email will be returned. Otherwise, you will receive either:
-	// ErrNotFound, ErrPasswordIncorrect, or another error if something goes
-	// wrong.
+	// ErrCredentialsInvalid, or another error if something goes wrong.
+	// Unknown email addresses and wrong passwords get the same error
+	// and take about as long, so they cannot be told apart.
 	Authenticate(email, password string) (*User, error)
 
 	// InitiateReset will start the reset password reset by creating the
 	// reset password token for the user found with the provide email.
+	// Callers should not let users know when it returns ErrNotFound.
 	InitiateReset(email string) (string, error)
 	// CompleteReset will complete the reset password reset by updating the
 	// new password for the user and deleting the password reset token.
 	CompleteReset(token, newPw string) (*User, error)
+
+	// InitiateVerification will create the token proving the user
+	// owns their current email address. Tokens created before for
+	// the user stop working.
+	InitiateVerification(user *User) (string, error)
+	// CompleteVerification will mark the email address the token
+	// was created for as verified and return its user.
+	CompleteVerification(token string) (*User, error)
+
+	// ChangeEmail will change the email address of the user after
+	// checking their password. It returns ErrPasswordIncorrect if
+	// the password is wrong or the user has none. The new address
+	// has to be verified again.
+	ChangeEmail(user *User, pw, email string) error
+	// ChangePassword will change the password of the user after
+	// checking the current one, and replace their remember token.
+	// It returns ErrPasswordIncorrect if the current password is
+	// wrong or the user has none.
+	ChangePassword(user *User, currentPw, newPw string) error
+
+	// ScheduleDeletion will schedule the account of the user for
+	// deletion after AccountDeletionGracePeriod, once they entered
+	// their password. It returns ErrPasswordIncorrect if the
+	// password is wrong or the user has none. Users without a
+	// password confirm by email instead, see InitiateDeletion.
+	ScheduleDeletion(user *User, pw string) error
+	// InitiateDeletion will create the token of a link confirming
+	// the deletion of the account of the user.
+	InitiateDeletion(user *User) (string, error)
+	// CompleteDeletion will schedule the account of the user for
+	// deletion like ScheduleDeletion, once they followed the link.
+	// The token must have been created for the user, and only works
+	// once.
+	CompleteDeletion(user *User, token string) error
+	// CancelDeletion will keep the account of the user.
+	CancelDeletion(user *User) error
+
+	// InitiateMagicLink will create the token of a link logging in
+	// the user found with the email, without their password.
+	// Callers should not let users know when it returns ErrNotFound.
+	InitiateMagicLink(email string) (string, error)
+	// CompleteMagicLink will return the user the token was created
+	// for. Each token only works once.
+	CompleteMagicLink(token string) (*User, error)
 	UserDB
 }
 
-func NewUserService(db *gorm.DB, hmacKeyString, pepper string) UserService {
+// NewUserService returns a UserService. Passwords are hashed with
+// hasher, and those users choose must follow pwPolicy.
+func NewUserService(db *gorm.DB, hmacKeyString string, hasher *password.Hasher, pwPolicy *password.Policy) UserService {
 	ug := &userGorm{
 		db: db,
 	}
 
 	hmac := hash.NewHMAC(hmacKeyString)
-	uVal := newUserValidator(ug, hmac, pepper)
+	uVal := newUserValidator(ug, hmac, hasher, pwPolicy)
+
+	// Authenticate verifies passwords against this hash when there
+	// is no user with the email, the result does not matter.
+	dummyHash, err := hasher.Hash("goweb.learn")
+	if err != nil {
+		panic(err)
+	}
 
 	return &userService{
-		UserDB: uVal,
-		pepper: pepper,
+		UserDB:    uVal,
+		hasher:    hasher,
+		dummyHash: dummyHash,
 		pwResetDB: newPwResetValidator(&pwResetGorm{
 			db: db,
 		}, hmac),
+		emailVerificationDB: newEmailVerificationValidator(&emailVerificationGorm{
+			db: db,
+		}, hmac),
+		magicLinkDB: newMagicLinkValidator(&magicLinkGorm{
+			db: db,
+		}, hmac),
 	}
 }
 
 type userService struct {
 	UserDB
-	pepper    string
-	pwResetDB pwResetDB
+	hasher              *password.Hasher
+	dummyHash           string
+	pwResetDB           pwResetDB
+	emailVerificationDB emailVerificationDB
+	magicLinkDB         magicLinkDB
 }
 
 // Authenticate can be used to authenticate a user with
-// the provided email address and password.
-func (us *userService) Authenticate(email, password string) (*User, error) {
+// the provided email address and password. Password hashes made
+// with an outdated algorithm, cost or pepper are replaced on the
+// way.
+func (us *userService) Authenticate(email, pw string) (*User, error) {
 	foundUser, err := us.ByEmail(email)
+	if err == nil && !foundUser.HasPassword() {
+		err = ErrNotFound
+	}
+	if err == ErrNotFound {
+		// Verify anyway so that unknown email addresses take as
+		// long as wrong passwords.
+		_, _ = us.hasher.Verify(us.dummyHash, pw)
+		return nil, ErrCredentialsInvalid
+	}
 	if err != nil {
 		return nil, err
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+us.pepper))
+	rehash, err := us.hasher.Verify(foundUser.PasswordHash, pw)
 	if err != nil {
 		switch err {
-		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, ErrPasswordIncorrect
+		case password.ErrMismatch:
+			return nil, ErrCredentialsInvalid
 		default:
 			return nil, err
 		}
 	}
+	if rehash {
+		// The old hash still works, so failing to replace it is
+		// not worth failing the login. The password is not checked
+		// against the password policy again, it may have changed.
+		if err := us.rehash(foundUser, pw); err != nil {
+			log.Println(err)
+		}
+	}
 	return foundUser, nil
 }
 
+// rehash will replace the password hash of the user with one made
+// with the current algorithm and pepper.
+func (us *userService) rehash(user *User, pw string) error {
+	hash, err := us.hasher.Hash(pw)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	return us.Update(user)
+}
+
 func (us *userService) InitiateReset(email string) (string, error) {
 	user, err := us.ByEmail(email)
 	if err != nil {
@@ -149,6 +294,210 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 	return user, nil
 }
 
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	if user.Verified() {
+		return "", ErrEmailAlreadyVerified
+	}
+	if err := us.emailVerificationDB.DeleteByUserID(user.ID); err != nil {
+		return "", err
+	}
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+	if err := us.emailVerificationDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.emailVerificationDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrVerificationInvalid
+		}
+		return nil, err
+	}
+	if time.Since(ev.CreatedAt) > EmailVerificationDuration {
+		return nil, ErrVerificationInvalid
+	}
+	user, err := us.ByID(ev.UserID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrVerificationInvalid
+		}
+		return nil, err
+	}
+	if user.Email != ev.Email {
+		return nil, ErrVerificationInvalid
+	}
+	now := time.Now()
+	user.VerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	_ = us.emailVerificationDB.DeleteByUserID(user.ID)
+	return user, nil
+}
+
+func (us *userService) ChangeEmail(user *User, pw, email string) error {
+	if err := us.checkPassword(user, pw); err != nil {
+		return err
+	}
+	old := *user
+	user.Email = email
+	if err := us.Update(user); err != nil {
+		*user = old
+		return err
+	}
+	return nil
+}
+
+func (us *userService) ChangePassword(user *User, currentPw, newPw string) error {
+	if err := us.checkPassword(user, currentPw); err != nil {
+		return err
+	}
+	if newPw == "" {
+		return ErrPasswordRequired
+	}
+	remember, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	old := *user
+	user.Password = newPw
+	user.Remember = remember
+	if err := us.Update(user); err != nil {
+		*user = old
+		return err
+	}
+	return nil
+}
+
+func (us *userService) ScheduleDeletion(user *User, pw string) error {
+	if err := us.checkPassword(user, pw); err != nil {
+		return err
+	}
+	return us.scheduleDeletion(user)
+}
+
+func (us *userService) InitiateDeletion(user *User) (string, error) {
+	ml := magicLink{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Purpose: magicLinkDeletion,
+	}
+	if err := us.magicLinkDB.Create(&ml); err != nil {
+		return "", err
+	}
+	return ml.Token, nil
+}
+
+func (us *userService) CompleteDeletion(user *User, token string) error {
+	ml, err := us.useMagicLink(token, magicLinkDeletion, DeletionLinkDuration)
+	if err == ErrMagicLinkInvalid {
+		return ErrDeletionLinkInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if ml.UserID != user.ID || ml.Email != user.Email {
+		return ErrDeletionLinkInvalid
+	}
+	return us.scheduleDeletion(user)
+}
+
+func (us *userService) scheduleDeletion(user *User) error {
+	deleteAt := time.Now().Add(AccountDeletionGracePeriod)
+	user.DeleteAt = &deleteAt
+	if err := us.Update(user); err != nil {
+		user.DeleteAt = nil
+		return err
+	}
+	return nil
+}
+
+func (us *userService) CancelDeletion(user *User) error {
+	deleteAt := user.DeleteAt
+	user.DeleteAt = nil
+	if err := us.Update(user); err != nil {
+		user.DeleteAt = deleteAt
+		return err
+	}
+	return nil
+}
+
+// checkPassword returns ErrPasswordIncorrect unless pw is the
+// password of the user.
+func (us *userService) checkPassword(user *User, pw string) error {
+	if !user.HasPassword() {
+		return ErrPasswordIncorrect
+	}
+	if _, err := us.hasher.Verify(user.PasswordHash, pw); err != nil {
+		if err == password.ErrMismatch {
+			return ErrPasswordIncorrect
+		}
+		return err
+	}
+	return nil
+}
+
+func (us *userService) InitiateMagicLink(email string) (string, error) {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	ml := magicLink{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+	if err := us.magicLinkDB.Create(&ml); err != nil {
+		return "", err
+	}
+	return ml.Token, nil
+}
+
+func (us *userService) CompleteMagicLink(token string) (*User, error) {
+	ml, err := us.useMagicLink(token, magicLinkLogin, MagicLinkDuration)
+	if err != nil {
+		return nil, err
+	}
+	user, err := us.ByID(ml.UserID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrMagicLinkInvalid
+		}
+		return nil, err
+	}
+	if user.Email != ml.Email {
+		return nil, ErrMagicLinkInvalid
+	}
+	return user, nil
+}
+
+// useMagicLink will delete the link with the token and purpose, and
+// return it unless it is older than maxAge. Whoever deletes the link
+// gets to use it, so two requests racing with the same link cannot
+// both succeed. It returns ErrMagicLinkInvalid if there is no such
+// link or it expired.
+func (us *userService) useMagicLink(token, purpose string, maxAge time.Duration) (*magicLink, error) {
+	ml, err := us.magicLinkDB.ByToken(token, purpose)
+	if err == nil {
+		err = us.magicLinkDB.Delete(ml.ID)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrMagicLinkInvalid
+		}
+		return nil, err
+	}
+	if time.Since(ml.CreatedAt) > maxAge {
+		return nil, ErrMagicLinkInvalid
+	}
+	return ml, nil
+}
+
 type userValFunc func(*User) error
 
 func runUserValFuncs(user *User, fns ...userValFunc) error {
@@ -160,12 +509,13 @@ func runUserValFuncs(user *User, fns ...userValFunc) error {
 	return nil
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, hmac hash.HMAC, hasher *password.Hasher, pwPolicy *password.Policy) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
 		hmac:       hmac,
 		emailRegex: regexp.MustCompile(`^[a-z0-9.%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
-		pepper:     pepper,
+		hasher:     hasher,
+		pwPolicy:   pwPolicy,
 	}
 }
 
@@ -173,7 +523,8 @@ type userValidator struct {
 	UserDB
 	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
-	pepper     string
+	hasher     *password.Hasher
+	pwPolicy   *password.Policy
 }
 
 // ByEmail will normalize the email address
@@ -205,8 +556,8 @@ func (uv *userValidator) ByRemember(token string) (*User, error) {
 func (uv *userValidator) Create(user *User) error {
 	err := runUserValFuncs(user,
 		uv.passwordRequired,
-		uv.passwordMinLength,
-		uv.bcryptPassword,
+		uv.passwordPolicy,
+		uv.hashPassword,
 		uv.passwordHashRequired,
 		uv.setDefaultRemember,
 		uv.rememberMinBytes,
@@ -223,12 +574,33 @@ func (uv *userValidator) Create(user *User) error {
 	return uv.UserDB.Create(user)
 }
 
-// Update will hash a remember token if it is provided.
+// CreatePasswordless is like Create, but for users without a
+// password.
+func (uv *userValidator) CreatePasswordless(user *User) error {
+	err := runUserValFuncs(user,
+		uv.passwordless,
+		uv.setDefaultRemember,
+		uv.rememberMinBytes,
+		uv.hmacRemember,
+		uv.rememberHashRequired,
+		uv.emailNormalize,
+		uv.emailRequire,
+		uv.emailFormat,
+		uv.emailIsAvail,
+	)
+	if err != nil {
+		return err
+	}
+	return uv.UserDB.CreatePasswordless(user)
+}
+
+// Update will hash a remember token if it is provided. The
+// password hash may be empty, for users who signed up with an
+// identity provider.
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValFuncs(user,
-		uv.passwordMinLength,
-		uv.bcryptPassword,
-		uv.passwordHashRequired,
+		uv.passwordPolicy,
+		uv.hashPassword,
 		uv.rememberMinBytes,
 		uv.hmacRemember,
 		uv.rememberHashRequired,
@@ -236,6 +608,7 @@ func (uv *userValidator) Update(user *User) error {
 		uv.emailRequire,
 		uv.emailFormat,
 		uv.emailIsAvail,
+		uv.unverifyChangedEmail,
 	)
 	if err != nil {
 		return err
@@ -253,20 +626,19 @@ func (uv *userValidator) Delete(ID uint) error {
 	return uv.UserDB.Delete(user.ID)
 }
 
-// bcryptPassword will hash a user's password with the
-// predefined peper and bcrypt if the password field is
-// not the empty string.
-func (uv *userValidator) bcryptPassword(user *User) error {
+// hashPassword will hash a user's password with the current
+// algorithm and pepper if the password field is not the empty
+// string.
+func (uv *userValidator) hashPassword(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
 
-	pwBytes := []byte(user.Password + uv.pepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
+	hash, err := uv.hasher.Hash(user.Password)
 	if err != nil {
 		return err
 	}
-	user.PasswordHash = string(hashedBytes)
+	user.PasswordHash = hash
 	user.Password = ""
 
 	return nil
@@ -339,16 +711,31 @@ func (uv *userValidator) emailIsAvail(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) passwordMinLength(user *User) error {
-	if user.Password == "" {
+// unverifyChangedEmail will clear VerifiedAt when the email address
+// of the user changes, since we only know they own the old one.
+func (uv *userValidator) unverifyChangedEmail(user *User) error {
+	if user.VerifiedAt == nil {
 		return nil
 	}
-	if len(user.Password) < 8 {
-		return ErrPasswordTooShort
+	existing, err := uv.UserDB.ByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if existing.Email != user.Email {
+		user.VerifiedAt = nil
 	}
 	return nil
 }
 
+// passwordPolicy makes sure a new password follows the password
+// policy, which also keeps the email and name out of it.
+func (uv *userValidator) passwordPolicy(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	return uv.pwPolicy.Check(user.Password, user.Email, user.Name)
+}
+
 func (uv *userValidator) passwordRequired(user *User) error {
 	if user.Password == "" {
 		return ErrPasswordRequired
@@ -356,6 +743,12 @@ func (uv *userValidator) passwordRequired(user *User) error {
 	return nil
 }
 
+func (uv *userValidator) passwordless(user *User) error {
+	user.Password = ""
+	user.PasswordHash = ""
+	return nil
+}
+
 func (uv *userValidator) passwordHashRequired(user *User) error {
 	if user.PasswordHash == "" {
 		return ErrPasswordRequired
@@ -429,6 +822,10 @@ func (ug *userGorm) Create(user *User) error {
 	return ug.db.Create(user).Error
 }
 
+func (ug *userGorm) CreatePasswordless(user *User) error {
+	return ug.Create(user)
+}
+
 // Update will update the provided user with all of the data
 // in the provided user object.
 func (ug *userGorm) Update(user *User) error {
@@ -0,0 +1,206 @@
+// Package oidc lets users log in with an OpenID Connect identity
+// provider, using the authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/rand"
+)
+
+// randomBytes is the size of the states, nonces and PKCE verifiers
+// we generate.
+const randomBytes = 32
+
+// ErrInvalidToken is returned when the ID token sent by the
+// provider cannot be trusted.
+var ErrInvalidToken = errors.New("oidc: invalid ID token")
+
+// Config describes an identity provider and our client there.
+type Config struct {
+	// Name identifies the provider in URLs and the database, eg:
+	// "google". It must not change once users linked accounts.
+	Name string
+	// DisplayName is shown on the buttons, eg: "Google".
+	DisplayName string
+	// Issuer is the URL the discovery document is found under,
+	// eg: https://accounts.google.com.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is our callback URL registered with the
+	// provider.
+	RedirectURL string
+	// Scopes are asked for on top of "openid". Defaults to email
+	// and profile.
+	Scopes []string
+}
+
+// Claims are what we use from a verified ID token.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// metadata is the part of the discovery document we use.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func New(cfg Config) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	return &Provider{
+		Config: cfg,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Provider is an identity provider. Its discovery document and keys
+// are fetched the first time they are needed, so the app can start
+// while the provider is down.
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu   sync.Mutex
+	meta *metadata
+	keys *keySet
+}
+
+// NewState returns a random value for the state, nonce or PKCE
+// verifier of a login.
+func NewState() (string, error) {
+	b, err := rand.Bytes(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// challenge is the S256 PKCE challenge of the verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the URL to send users to so they log in with the
+// provider. The state, nonce and verifier must be kept until the
+// callback, see Exchange.
+func (p *Provider) AuthURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", "openid "+strings.Join(p.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", challenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the code the provider sent to the callback for
+// an ID token, and returns its claims once it is verified. The
+// nonce and verifier are the ones given to AuthURL.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (*Claims, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := p.do(req, &token); err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("oidc: no ID token in token response: %s", token.Error)
+	}
+	return p.verify(ctx, meta, token.IDToken, nonce)
+}
+
+// metadata returns the discovery document of the provider.
+func (p *Provider) metadata(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	var meta metadata
+	if err := p.do(req, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", meta.Issuer, p.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: incomplete discovery document for %q", p.Issuer)
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// do sends the request and decodes the JSON response into dst.
+func (p *Provider) do(req *http.Request, dst interface{}) error {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s %s: %s: %s", req.Method, req.URL, res.Status, body)
+	}
+	return json.Unmarshal(body, dst)
+}
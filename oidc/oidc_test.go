@@ -0,0 +1,153 @@
+package oidc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/oidc/oidctest"
+)
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testRedirectURL  = "http://localhost:3000/auth/test/callback"
+)
+
+func testProvider(issuer string) *Provider {
+	return New(Config{
+		Name:         "test",
+		DisplayName:  "Test",
+		Issuer:       issuer,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	})
+}
+
+// login logs in at the provider, and exchanges the code it sends
+// back with the verifier.
+func login(t *testing.T, p *Provider, srv *oidctest.Server, nonce, verifier string) (*Claims, error) {
+	t.Helper()
+	ctx := context.Background()
+	authURL, err := p.AuthURL(ctx, "state", nonce, "verifier")
+	if err != nil {
+		return nil, err
+	}
+	callback, err := srv.Login(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Split(callback.String(), "?")[0]; got != testRedirectURL {
+		t.Fatalf("redirected to %q, want %q", got, testRedirectURL)
+	}
+	if got := callback.Query().Get("state"); got != "state" {
+		t.Fatalf("got state %q, want %q", got, "state")
+	}
+	return p.Exchange(ctx, callback.Query().Get("code"), nonce, verifier)
+}
+
+func TestExchange(t *testing.T) {
+	srv := oidctest.NewServer(testClientID, testClientSecret)
+	defer srv.Close()
+	srv.Claims = map[string]interface{}{
+		"sub":            "1234",
+		"email":          " Jon@Example.com",
+		"email_verified": true,
+		"name":           "Jon Calhoun",
+	}
+
+	claims, err := login(t, testProvider(srv.URL), srv, "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{
+		Subject:       "1234",
+		Email:         "jon@example.com",
+		EmailVerified: true,
+		Name:          "Jon Calhoun",
+	}
+	if *claims != want {
+		t.Fatalf("got %+v, want %+v", *claims, want)
+	}
+}
+
+func TestExchangeEmailVerified(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  bool
+	}{
+		{true, true},
+		{false, false},
+		{"true", true},
+		{"false", false},
+		{nil, false},
+	}
+	srv := oidctest.NewServer(testClientID, testClientSecret)
+	defer srv.Close()
+	p := testProvider(srv.URL)
+	for _, tc := range tests {
+		srv.Claims = map[string]interface{}{"email_verified": tc.value}
+		claims, err := login(t, p, srv, "nonce", "verifier")
+		if err != nil {
+			t.Fatalf("email_verified %#v: %v", tc.value, err)
+		}
+		if claims.EmailVerified != tc.want {
+			t.Fatalf("email_verified %#v: got %v, want %v", tc.value, claims.EmailVerified, tc.want)
+		}
+	}
+}
+
+func TestExchangeInvalidToken(t *testing.T) {
+	srv := oidctest.NewServer(testClientID, testClientSecret)
+	defer srv.Close()
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+	}{
+		{"nonce mismatch", map[string]interface{}{"nonce": "other"}},
+		{"no nonce", map[string]interface{}{"nonce": ""}},
+		{"aud mismatch", map[string]interface{}{"aud": "other"}},
+		{"aud list without us", map[string]interface{}{"aud": []string{"other", "another"}}},
+		{"iss mismatch", map[string]interface{}{"iss": "https://evil.example.com"}},
+		{"no subject", map[string]interface{}{"sub": ""}},
+		{"expired", map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}},
+		{"issued in the future", map[string]interface{}{"iat": now.Add(2 * time.Minute).Unix()}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.Claims = tc.claims
+			_, err := login(t, testProvider(srv.URL), srv, "nonce", "verifier")
+			if err != ErrInvalidToken {
+				t.Fatalf("got %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+
+	t.Run("aud list with us", func(t *testing.T) {
+		srv.Claims = map[string]interface{}{"aud": []string{"other", testClientID}}
+		if _, err := login(t, testProvider(srv.URL), srv, "nonce", "verifier"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	srv := oidctest.NewServer(testClientID, testClientSecret)
+	defer srv.Close()
+	_, err := login(t, testProvider(srv.URL), srv, "nonce", "other")
+	if err == nil {
+		t.Fatal("got no error, want the code to be refused")
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	srv := oidctest.NewServer(testClientID, testClientSecret)
+	defer srv.Close()
+	p := testProvider(srv.URL + "/")
+	if _, err := p.AuthURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Fatal("got no error, want the discovery document to be refused")
+	}
+}
@@ -0,0 +1,56 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prefixLen is the number of hex characters of the SHA-1 hash that
+// name a range file.
+const prefixLen = 5
+
+// BreachedList looks passwords up in a local copy of a breached
+// password list, split into range files like the k-anonymity API of
+// Have I Been Pwned: the file named after the first 5 characters of
+// the uppercase SHA-1 hash of a password, eg: "5BAA6" or
+// "5BAA6.txt", holds the rest of the hashes starting with them, one
+// "SUFFIX:COUNT" per line.
+type BreachedList struct {
+	Dir string
+}
+
+// Contains reports whether the password is in the list. Missing
+// range files are treated as empty.
+func (l *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:prefixLen], hash[prefixLen:]
+
+	f, err := os.Open(filepath.Join(l.Dir, prefix+".txt"))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(l.Dir, prefix))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(strings.TrimSpace(line), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,194 @@
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/monkjunior/goweb.learn/rand"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+
+	// recordPrefix starts the hashes made by a Hasher, followed by
+	// the ID of the pepper and the hash of the algorithm:
+	//
+	//	$gwl1$<pepper id>$2a$10$...
+	//	$gwl1$<pepper id>$argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+	//
+	// Older hashes are plain bcrypt hashes of the password followed
+	// by the pepper with the empty ID.
+	recordPrefix = "$gwl1$"
+
+	argon2SaltBytes = 16
+	argon2KeyLen    = 32
+)
+
+var (
+	// ErrMismatch is returned when the password does not match
+	// the hash.
+	ErrMismatch = errors.New("password: password does not match")
+	// ErrUnknownPepper is returned when a hash was made with a
+	// pepper the Hasher does not have, which must not be removed
+	// until no hash uses it.
+	ErrUnknownPepper = errors.New("password: unknown pepper")
+	// ErrHashInvalid is returned for hashes that cannot be read.
+	ErrHashInvalid = errors.New("password: invalid hash")
+)
+
+// Argon2Params are the cost parameters of argon2id. Memory is in
+// KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// Hasher hashes passwords with the current algorithm and pepper,
+// and verifies hashes made with any of them, so the algorithm, its
+// cost and the pepper can change without locking users out.
+type Hasher struct {
+	// Algorithm is Bcrypt or Argon2id.
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+	// Peppers are secrets mixed into every password, by ID. The
+	// empty ID is the pepper of the hashes made before there were
+	// IDs.
+	Peppers map[string]string
+	// PepperID is the pepper new hashes are made with.
+	PepperID string
+}
+
+// Hash returns the hash of the password to store.
+func (h *Hasher) Hash(password string) (string, error) {
+	pepper, ok := h.Peppers[h.PepperID]
+	if !ok {
+		return "", ErrUnknownPepper
+	}
+	pw := peppered(password, pepper)
+	var hash string
+	switch h.Algorithm {
+	case Bcrypt:
+		b, err := bcrypt.GenerateFromPassword(pw, h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		hash = string(b)
+	case Argon2id:
+		salt, err := rand.Bytes(argon2SaltBytes)
+		if err != nil {
+			return "", err
+		}
+		p := h.Argon2
+		key := argon2.IDKey(pw, salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
+		hash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			p.Memory, p.Time, p.Threads, b64.EncodeToString(salt), b64.EncodeToString(key))
+	default:
+		return "", fmt.Errorf("password: unknown algorithm %q", h.Algorithm)
+	}
+	return recordPrefix + h.PepperID + hash, nil
+}
+
+// Verify returns nil if the password matches the hash, or
+// ErrMismatch if it does not. Rehash is true when the hash was not
+// made with the current algorithm, cost and pepper, and should be
+// replaced by a new one now that we know the password.
+func (h *Hasher) Verify(hash, password string) (rehash bool, err error) {
+	pepperID, algoHash, legacy := parseRecord(hash)
+	pepper, ok := h.Peppers[pepperID]
+	if !ok {
+		return false, ErrUnknownPepper
+	}
+	var pw []byte
+	if legacy {
+		pw = []byte(password + pepper)
+	} else {
+		pw = peppered(password, pepper)
+	}
+	rehash = legacy || pepperID != h.PepperID
+
+	switch {
+	case strings.HasPrefix(algoHash, "$2"):
+		if err := bcrypt.CompareHashAndPassword([]byte(algoHash), pw); err != nil {
+			if err == bcrypt.ErrMismatchedHashAndPassword {
+				return false, ErrMismatch
+			}
+			return false, err
+		}
+		cost, err := bcrypt.Cost([]byte(algoHash))
+		if err != nil {
+			return false, err
+		}
+		rehash = rehash || h.Algorithm != Bcrypt || cost != h.BcryptCost
+	case strings.HasPrefix(algoHash, "$argon2id$"):
+		p, salt, key, err := parseArgon2(algoHash)
+		if err != nil {
+			return false, err
+		}
+		got := argon2.IDKey(pw, salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, ErrMismatch
+		}
+		rehash = rehash || h.Algorithm != Argon2id || p != h.Argon2
+	default:
+		return false, ErrHashInvalid
+	}
+	return rehash, nil
+}
+
+var b64 = base64.RawStdEncoding
+
+// peppered mixes the pepper into the password with HMAC-SHA256.
+// Unlike appending it, this keeps the input short enough for bcrypt
+// which ignores anything past 72 bytes.
+func peppered(password, pepper string) []byte {
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// parseRecord splits a stored hash into the ID of its pepper and
+// the hash made by the algorithm. Legacy is true for the hashes
+// made before records had a prefix.
+func parseRecord(hash string) (pepperID, algoHash string, legacy bool) {
+	if !strings.HasPrefix(hash, recordPrefix) {
+		return "", hash, true
+	}
+	rest := hash[len(recordPrefix):]
+	i := strings.IndexByte(rest, '$')
+	if i < 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i:], false
+}
+
+func parseArgon2(hash string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	if len(parts) != 6 {
+		return p, nil, nil, ErrHashInvalid
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrHashInvalid
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrHashInvalid
+	}
+	if salt, err = b64.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrHashInvalid
+	}
+	if key, err = b64.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, ErrHashInvalid
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,107 @@
+// Package password decides which passwords users may choose.
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error is returned when a password does not follow the policy. Its
+// message is meant to be shown to users.
+type Error string
+
+func (e Error) Error() string {
+	return "password: " + string(e)
+}
+
+func (e Error) Public() string {
+	return string(e)
+}
+
+const (
+	ErrPersonal Error = "Password must not contain your email address or name"
+	ErrBreached Error = "Password has appeared in a data breach, please choose another one"
+)
+
+// Policy is the set of rules passwords must follow. Lengths are
+// counted in characters, not bytes.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// MinStrength is the lowest Strength score accepted, from 0 to
+	// 4. Zero accepts any password.
+	MinStrength int
+	// Breached, if set, is checked for passwords known to have
+	// leaked.
+	Breached *BreachedList
+}
+
+// Check returns an Error if the password does not follow the
+// policy. Personal are things like the email address and the name
+// of the user, which the password must not contain. Other errors
+// mean the check could not be done.
+func (p *Policy) Check(password string, personal ...string) error {
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		return Error(fmt.Sprintf("Password must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return Error(fmt.Sprintf("Password must be at most %d characters", p.MaxLength))
+	}
+	if containsPersonal(password, personal) {
+		return ErrPersonal
+	}
+	if score, feedback := Strength(password, personal...); score < p.MinStrength {
+		return Error("Password is too easy to guess. " + feedback)
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return ErrBreached
+		}
+	}
+	return nil
+}
+
+// minPersonalLen is the shortest personal word we look for, so a
+// name like "Al" does not forbid every password with "al" in it.
+const minPersonalLen = 3
+
+// personalWords splits the personal info into the words passwords
+// must not contain, eg: an email address gives the address, its
+// local part and the words of the local part.
+func personalWords(personal []string) []string {
+	var words []string
+	for _, p := range personal {
+		p = strings.ToLower(strings.TrimSpace(p))
+		words = append(words, p)
+		if at := strings.LastIndex(p, "@"); at >= 0 {
+			p = p[:at]
+			words = append(words, p)
+		}
+		words = append(words, strings.FieldsFunc(p, func(r rune) bool {
+			return r == ' ' || r == '.' || r == '_' || r == '-' || r == '+'
+		})...)
+	}
+	ret := words[:0]
+	for _, w := range words {
+		if utf8.RuneCountInString(w) >= minPersonalLen {
+			ret = append(ret, w)
+		}
+	}
+	return ret
+}
+
+func containsPersonal(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, w := range personalWords(personal) {
+		if strings.Contains(lower, w) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// common are some of the most used passwords and the patterns they
+// are built from. Passwords made of them are guessed first.
+var common = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345",
+	"1234", "111111", "1234567", "dragon", "123123", "baseball",
+	"abc123", "football", "monkey", "letmein", "696969", "shadow",
+	"master", "666666", "qwertyuiop", "123321", "mustang",
+	"1234567890", "michael", "654321", "superman", "1qaz2wsx",
+	"7777777", "121212", "000000", "qazwsx", "123qwe", "killer",
+	"trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger",
+	"sunshine", "iloveyou", "charlie", "robert", "thomas", "hockey",
+	"ranger", "daniel", "starwars", "klaster", "112233", "george",
+	"computer", "michelle", "jessica", "pepper", "zxcvbn", "asdf",
+	"asdfghjkl", "welcome", "admin", "login", "princess", "passw0rd",
+	"qwerty123", "solo", "summer", "winter", "spring", "autumn",
+	"secret", "freedom", "whatever", "access", "flower", "hello",
+}
+
+// commonGuesses is about how many guesses it takes to try every
+// common password, with a few variations each.
+var commonGuesses = float64(len(common) * 10)
+
+// Strength estimates how hard the password is to guess, from 0
+// (guessed right away) to 4 (very hard to guess), and returns
+// feedback on how to improve it. Personal info of the user, such as
+// their email address, is guessed first.
+func Strength(password string, personal ...string) (int, string) {
+	lower := strings.ToLower(password)
+	for _, c := range common {
+		if lower == c || strings.Trim(lower, "0123456789!.") == c {
+			return 0, "It is one of the most common passwords."
+		}
+	}
+	words := append(personalWords(personal), common...)
+
+	feedback := ""
+	bits := 0.0
+	// Parts of the password found in the lists only cost an attacker
+	// a guess in the list each.
+	for _, w := range words {
+		if len(w) >= 4 && strings.Contains(lower, w) {
+			lower = strings.Replace(lower, w, "", -1)
+			bits += math.Log2(commonGuesses)
+			feedback = "Avoid common words and passwords."
+		}
+	}
+
+	perChar := math.Log2(float64(charsetSize(password)))
+	var prev rune = -1
+	n, repeats := 0, 0
+	for _, r := range lower {
+		n++
+		// Repeated characters and sequences like abc or 321 hardly
+		// add anything.
+		if prev >= 0 && (r == prev || r == prev+1 || r == prev-1) {
+			bits++
+			repeats++
+		} else {
+			bits += perChar
+		}
+		prev = r
+	}
+	if feedback == "" && repeats > 2 && repeats*3 > n {
+		feedback = "Avoid repeated characters and sequences like abc or 1234."
+	}
+
+	score := 0
+	switch {
+	case bits >= 80:
+		score = 4
+	case bits >= 60:
+		score = 3
+	case bits >= 36:
+		score = 2
+	case bits >= 28:
+		score = 1
+	}
+	if feedback == "" {
+		feedback = "Make it longer, a few random words are easy to remember and hard to guess."
+	}
+	return score, feedback
+}
+
+// charsetSize is the number of characters an attacker would try
+// for each character of the password.
+func charsetSize(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	if lower {
+		n += 26
+	}
+	if upper {
+		n += 26
+	}
+	if digit {
+		n += 10
+	}
+	if symbol {
+		n += 33
+	}
+	if other {
+		n += 100
+	}
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,221 @@
+// Package policy decides what users are allowed to do with
+// galleries and their images.
+package policy
+
+import (
+	"errors"
+
+	"github.com/monkjunior/goweb.learn/models"
+)
+
+// Action is something a user wants to do with a resource.
+type Action string
+
+const (
+	// ActionView is seeing a gallery or an image.
+	ActionView Action = "view"
+	// ActionUpload is adding images to a gallery.
+	ActionUpload Action = "upload"
+	// ActionEdit is changing the title of a gallery.
+	ActionEdit Action = "edit"
+	// ActionDelete is deleting a gallery or an image.
+	ActionDelete Action = "delete"
+	// ActionDeleteImages is deleting images of a gallery. It is
+	// checked on the gallery, where ActionDelete would be about the
+	// gallery itself.
+	ActionDeleteImages Action = "delete_images"
+	// ActionShare is changing the visibility or the share link of
+	// a gallery.
+	ActionShare Action = "share"
+	// ActionManageMembers is inviting, changing and removing the
+	// members of a gallery.
+	ActionManageMembers Action = "manage_members"
+)
+
+var (
+	// ErrNotFound is returned when the user is not allowed to
+	// see the resource at all. Handlers should respond as if the
+	// resource did not exist, so we do not reveal that it does.
+	ErrNotFound = errors.New("policy: resource not found")
+	// ErrForbidden is returned when the user can see the resource
+	// but is not allowed to perform the action.
+	ErrForbidden = errors.New("policy: action forbidden")
+	// ErrUnverified is returned when the action is restricted to
+	// users who verified their email address.
+	ErrUnverified = errors.New("policy: email address not verified")
+)
+
+// galleryPermissions maps the actions on a gallery to the
+// permission the role of the user must grant.
+var galleryPermissions = map[Action]models.Permission{
+	ActionView:          models.PermView,
+	ActionUpload:        models.PermUpload,
+	ActionEdit:          models.PermRename,
+	ActionDelete:        models.PermDeleteGallery,
+	ActionDeleteImages:  models.PermDeleteImages,
+	ActionShare:         models.PermManageMembers,
+	ActionManageMembers: models.PermManageMembers,
+}
+
+// imagePermissions maps the actions on an image to the permission
+// the role of the user must grant in the gallery of the image.
+var imagePermissions = map[Action]models.Permission{
+	ActionView:   models.PermView,
+	ActionDelete: models.PermDeleteImages,
+}
+
+// New returns a Policy. Users who did not verify their email
+// address may not perform the unverified actions, see Verified.
+func New(gs models.GalleryService, ms models.MemberService, unverified ...Action) *Policy {
+	p := Policy{
+		gs:         gs,
+		ms:         ms,
+		unverified: make(map[Action]bool, len(unverified)),
+	}
+	for _, action := range unverified {
+		p.unverified[action] = true
+	}
+	return &p
+}
+
+// Policy answers whether a user may perform an action on a
+// resource, looking up their role in the gallery involved.
+type Policy struct {
+	gs         models.GalleryService
+	ms         models.MemberService
+	unverified map[Action]bool
+}
+
+// Can reports whether the user may perform the action on the
+// resource, which must be a *models.Gallery or a *models.Image.
+// The user is nil for visitors who are not logged in.
+func (p *Policy) Can(user *models.User, action Action, resource interface{}) (bool, error) {
+	switch err := p.Authorize(user, action, resource); err {
+	case nil:
+		return true, nil
+	case ErrNotFound, ErrForbidden:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Authorize is like Can, but returns ErrNotFound or ErrForbidden
+// when the user may not perform the action.
+func (p *Policy) Authorize(user *models.User, action Action, resource interface{}) error {
+	switch res := resource.(type) {
+	case *models.Gallery:
+		role, err := p.Role(user, res)
+		if err != nil {
+			return err
+		}
+		return GalleryAllowed(role, action, res)
+	case *models.Image:
+		gallery, err := p.gs.ByID(res.GalleryID)
+		if err == models.ErrNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		role, err := p.Role(user, gallery)
+		if err != nil {
+			return err
+		}
+		return ImageAllowed(role, action, gallery)
+	}
+	return ErrForbidden
+}
+
+// SharedImage returns ErrNotFound unless the token is the share
+// token of the gallery of the image, and the gallery is not private.
+// It lets anyone with the share link of a gallery see its images.
+func (p *Policy) SharedImage(token string, image *models.Image) error {
+	if token == "" {
+		return ErrNotFound
+	}
+	gallery, err := p.gs.ByShareToken(token)
+	if err == models.ErrNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if gallery.ID != image.GalleryID || !gallery.IsShared() {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Gallery will look up the gallery with the provided ID and make
+// sure the user may perform the action on it. The Role of the
+// gallery is set to the role of the user. ErrNotFound is returned
+// when the gallery does not exist as well as when the user may not
+// see it.
+func (p *Policy) Gallery(user *models.User, id uint, action Action) (*models.Gallery, error) {
+	gallery, err := p.gs.ByID(id)
+	if err == models.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	role, err := p.Role(user, gallery)
+	if err != nil {
+		return nil, err
+	}
+	gallery.Role = role
+	if err := GalleryAllowed(role, action, gallery); err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
+
+// Verified returns ErrUnverified if the user has not verified their
+// email address and the action is restricted to those who did. It
+// does not look at roles, so it is checked on top of Gallery or
+// Authorize before anything is changed. Pages showing the forms
+// for the action are still allowed.
+func (p *Policy) Verified(user *models.User, action Action) error {
+	if user == nil || user.Verified() || !p.unverified[action] {
+		return nil
+	}
+	return ErrUnverified
+}
+
+// Role returns the role of the user in the gallery, or the empty
+// string if they have none.
+func (p *Policy) Role(user *models.User, gallery *models.Gallery) (string, error) {
+	if user == nil {
+		return "", nil
+	}
+	return p.ms.Role(gallery, user.ID)
+}
+
+// GalleryAllowed decides whether a user with the role may perform
+// the action on the gallery. It does not hit the database, so it
+// can be used once the role is known.
+func GalleryAllowed(role string, action Action, gallery *models.Gallery) error {
+	return allowed(galleryPermissions, role, action, gallery)
+}
+
+// ImageAllowed decides whether a user with the role may perform
+// the action on an image of the gallery.
+func ImageAllowed(role string, action Action, gallery *models.Gallery) error {
+	return allowed(imagePermissions, role, action, gallery)
+}
+
+func allowed(perms map[Action]models.Permission, role string, action Action, gallery *models.Gallery) error {
+	canView := gallery.IsPublic() || models.RoleCan(role, models.PermView)
+	if !canView {
+		return ErrNotFound
+	}
+	perm, ok := perms[action]
+	if !ok {
+		return ErrForbidden
+	}
+	if perm == models.PermView || models.RoleCan(role, perm) {
+		return nil
+	}
+	return ErrForbidden
+}
@@ -0,0 +1,271 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/monkjunior/goweb.learn/models"
+)
+
+// The users of the tests, by the role they have in the gallery.
+// Anonymous visitors are not logged in.
+const (
+	owner       = "owner"
+	editor      = "editor"
+	contributor = "contributor"
+	viewer      = "viewer"
+	nonMember   = "non-member"
+	anonymous   = "anonymous"
+)
+
+var testRoles = []string{owner, editor, contributor, viewer, nonMember, anonymous}
+
+var testUserIDs = map[string]uint{
+	owner:       1,
+	editor:      2,
+	contributor: 3,
+	viewer:      4,
+	nonMember:   5,
+}
+
+const (
+	testGalleryID  = 10
+	testShareToken = "share-token"
+)
+
+type fakeGalleries struct {
+	models.GalleryService
+	gallery models.Gallery
+}
+
+func (fg *fakeGalleries) ByID(id uint) (*models.Gallery, error) {
+	if id != fg.gallery.ID {
+		return nil, models.ErrNotFound
+	}
+	g := fg.gallery
+	return &g, nil
+}
+
+func (fg *fakeGalleries) ByShareToken(token string) (*models.Gallery, error) {
+	if token != fg.gallery.ShareToken {
+		return nil, models.ErrNotFound
+	}
+	g := fg.gallery
+	return &g, nil
+}
+
+type fakeMembers struct {
+	models.MemberService
+}
+
+func (fm *fakeMembers) Role(gallery *models.Gallery, userID uint) (string, error) {
+	if userID == gallery.UserID {
+		return models.RoleOwner, nil
+	}
+	switch userID {
+	case testUserIDs[editor]:
+		return models.RoleEditor, nil
+	case testUserIDs[contributor]:
+		return models.RoleContributor, nil
+	case testUserIDs[viewer]:
+		return models.RoleViewer, nil
+	}
+	return "", nil
+}
+
+func testUser(role string, verified bool) *models.User {
+	if role == anonymous {
+		return nil
+	}
+	user := models.User{Email: role + "@example.com"}
+	user.ID = testUserIDs[role]
+	if verified {
+		now := time.Now()
+		user.VerifiedAt = &now
+	}
+	return &user
+}
+
+func testPolicy(visibility string, unverified ...Action) *Policy {
+	gallery := models.Gallery{
+		UserID:     testUserIDs[owner],
+		Visibility: visibility,
+		ShareToken: testShareToken,
+	}
+	gallery.ID = testGalleryID
+	return New(&fakeGalleries{gallery: gallery}, &fakeMembers{}, unverified...)
+}
+
+// restricted are the actions unverified users may not perform in
+// the tests.
+var restricted = []Action{ActionUpload, ActionDeleteImages, ActionShare}
+
+func isRestricted(action Action) bool {
+	for _, a := range restricted {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// want is the error expected for each role.
+type want map[string]error
+
+// What each role may do in a private gallery, before email
+// verification is taken into account.
+var (
+	onlyOwner = want{owner: nil, editor: ErrForbidden, contributor: ErrForbidden, viewer: ErrForbidden, nonMember: ErrNotFound, anonymous: ErrNotFound}
+	editors   = want{owner: nil, editor: nil, contributor: ErrForbidden, viewer: ErrForbidden, nonMember: ErrNotFound, anonymous: ErrNotFound}
+	uploaders = want{owner: nil, editor: nil, contributor: nil, viewer: ErrForbidden, nonMember: ErrNotFound, anonymous: ErrNotFound}
+	members   = want{owner: nil, editor: nil, contributor: nil, viewer: nil, nonMember: ErrNotFound, anonymous: ErrNotFound}
+	everyone  = want{owner: nil, editor: nil, contributor: nil, viewer: nil, nonMember: nil, anonymous: nil}
+)
+
+// inPublic is what the roles may do in a public gallery, where
+// everyone can see it but only members can do anything else.
+func inPublic(w want) want {
+	public := want{}
+	for role, err := range w {
+		if err == ErrNotFound {
+			err = ErrForbidden
+		}
+		public[role] = err
+	}
+	return public
+}
+
+func TestGallery(t *testing.T) {
+	tests := []struct {
+		action     Action
+		visibility string
+		want       want
+	}{
+		{ActionView, models.VisibilityPrivate, members},
+		{ActionUpload, models.VisibilityPrivate, uploaders},
+		{ActionEdit, models.VisibilityPrivate, editors},
+		{ActionDelete, models.VisibilityPrivate, onlyOwner},
+		{ActionDeleteImages, models.VisibilityPrivate, editors},
+		{ActionShare, models.VisibilityPrivate, onlyOwner},
+		{ActionManageMembers, models.VisibilityPrivate, onlyOwner},
+		{ActionView, models.VisibilityPublic, everyone},
+		{ActionUpload, models.VisibilityPublic, inPublic(uploaders)},
+		{ActionEdit, models.VisibilityPublic, inPublic(editors)},
+		{ActionDelete, models.VisibilityPublic, inPublic(onlyOwner)},
+		{ActionDeleteImages, models.VisibilityPublic, inPublic(editors)},
+		{ActionShare, models.VisibilityPublic, inPublic(onlyOwner)},
+		{ActionManageMembers, models.VisibilityPublic, inPublic(onlyOwner)},
+	}
+	for _, tc := range tests {
+		for _, role := range testRoles {
+			for _, verified := range []bool{true, false} {
+				name := fmt.Sprintf("%s/%s/%s/verified=%v", tc.action, tc.visibility, role, verified)
+				t.Run(name, func(t *testing.T) {
+					want, ok := tc.want[role]
+					if !ok {
+						t.Fatalf("no expectation for role %q", role)
+					}
+					if want == nil && !verified && role != anonymous && isRestricted(tc.action) {
+						want = ErrUnverified
+					}
+
+					p := testPolicy(tc.visibility, restricted...)
+					user := testUser(role, verified)
+					gallery, err := p.Gallery(user, testGalleryID, tc.action)
+					if err == nil {
+						err = p.Verified(user, tc.action)
+					}
+					if err != want {
+						t.Fatalf("got %v, want %v", err, want)
+					}
+					if err == nil && gallery.ID != testGalleryID {
+						t.Fatalf("got gallery %d, want %d", gallery.ID, testGalleryID)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestGalleryNotFound(t *testing.T) {
+	p := testPolicy(models.VisibilityPublic)
+	_, err := p.Gallery(testUser(owner, true), testGalleryID+1, ActionView)
+	if err != ErrNotFound {
+		t.Fatalf("got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestAuthorizeImage(t *testing.T) {
+	tests := []struct {
+		action     Action
+		visibility string
+		want       want
+	}{
+		{ActionView, models.VisibilityPrivate, members},
+		{ActionDelete, models.VisibilityPrivate, editors},
+		{ActionView, models.VisibilityPublic, everyone},
+		{ActionDelete, models.VisibilityPublic, inPublic(editors)},
+	}
+	for _, tc := range tests {
+		for _, role := range testRoles {
+			name := fmt.Sprintf("%s/%s/%s", tc.action, tc.visibility, role)
+			t.Run(name, func(t *testing.T) {
+				p := testPolicy(tc.visibility)
+				image := models.Image{GalleryID: testGalleryID}
+				err := p.Authorize(testUser(role, true), tc.action, &image)
+				if want := tc.want[role]; err != want {
+					t.Fatalf("got %v, want %v", err, want)
+				}
+			})
+		}
+	}
+}
+
+func TestSharedImage(t *testing.T) {
+	tests := []struct {
+		name       string
+		visibility string
+		token      string
+		galleryID  uint
+		want       error
+	}{
+		{"unlisted", models.VisibilityUnlisted, testShareToken, testGalleryID, nil},
+		{"public", models.VisibilityPublic, testShareToken, testGalleryID, nil},
+		{"private", models.VisibilityPrivate, testShareToken, testGalleryID, ErrNotFound},
+		{"wrong token", models.VisibilityUnlisted, "nope", testGalleryID, ErrNotFound},
+		{"no token", models.VisibilityUnlisted, "", testGalleryID, ErrNotFound},
+		{"other gallery", models.VisibilityUnlisted, testShareToken, testGalleryID + 1, ErrNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := testPolicy(tc.visibility)
+			image := models.Image{GalleryID: tc.galleryID}
+			if err := p.SharedImage(tc.token, &image); err != tc.want {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerified(t *testing.T) {
+	p := New(nil, nil, ActionUpload)
+	tests := []struct {
+		name   string
+		user   *models.User
+		action Action
+		want   error
+	}{
+		{"anonymous", nil, ActionUpload, nil},
+		{"verified", testUser(owner, true), ActionUpload, nil},
+		{"unverified", testUser(owner, false), ActionUpload, ErrUnverified},
+		{"unrestricted", testUser(owner, false), ActionEdit, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := p.Verified(tc.user, tc.action); err != tc.want {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -3,9 +3,20 @@ package rand
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 )
 
-const RememberTokenBytes = 32
+const (
+	RememberTokenBytes = 32
+	ImageNameBytes     = 16
+	ShareTokenBytes    = 16
+	APITokenBytes      = 32
+	RecoveryCodeBytes  = 8
+
+	// APITokenPrefix starts every API token, so that they are
+	// easy to recognise, eg: by secret scanners.
+	APITokenPrefix = "gwl_"
+)
 
 // Bytes will help us generate a random bytes, or will
 // return an error if there was one. This uses the crypto/rand
@@ -45,3 +56,48 @@ func String(nBytes int) (string, error) {
 func RememberToken() (string, error) {
 	return String(RememberTokenBytes)
 }
+
+// Hex will generate a byte slice of size nBytes and then
+// return a string that is the hex encoded version of that
+// byte slice. Unlike String, the result is safe to use in
+// file names and URL paths without any escaping.
+func Hex(nBytes int) (string, error) {
+	b, err := Bytes(nBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ImageName is a helper function designed to generate the
+// names images are stored under, without an extension.
+func ImageName() (string, error) {
+	return Hex(ImageNameBytes)
+}
+
+// ShareToken is a helper function designed to generate the
+// secret tokens used in the links of unlisted galleries.
+func ShareToken() (string, error) {
+	return Hex(ShareTokenBytes)
+}
+
+// APIToken is a helper function designed to generate personal
+// API tokens.
+func APIToken() (string, error) {
+	s, err := String(APITokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return APITokenPrefix + s, nil
+}
+
+// RecoveryCode is a helper function designed to generate the
+// single-use codes users log in with when they lost their
+// authenticator app, eg: 0a1b2c3d-4e5f6a7b.
+func RecoveryCode() (string, error) {
+	s, err := Hex(RecoveryCodeBytes)
+	if err != nil {
+		return "", err
+	}
+	return s[:len(s)/2] + "-" + s[len(s)/2:], nil
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepEvery is how often the MemoryStore drops full buckets.
+const sweepEvery = time.Minute
+
+// NewMemoryStore returns a Store keeping the buckets in memory.
+// They are lost on restart and not shared between instances.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+type memoryBucket struct {
+	Bucket
+	// fullAt is when the bucket will be full again, after which
+	// it is the same as no bucket at all.
+	fullAt time.Time
+}
+
+// MemoryStore is a Store keeping the buckets in a map.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+func (s *MemoryStore) Take(key string, l Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	res := b.Take(l, now)
+	b.fullAt = now.Add(res.Reset)
+	return res, nil
+}
+
+// sweep drops the buckets that are full again so the map does not
+// grow forever. The lock must be held.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepEvery {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !now.Before(b.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+}
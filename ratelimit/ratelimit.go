@@ -0,0 +1,98 @@
+// Package ratelimit limits how often clients may make requests,
+// with token buckets.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit is the size of a bucket and how fast it refills. Each
+// request takes a token, so clients can make Burst requests at
+// once and then PerMinute requests a minute.
+type Limit struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// Enabled reports whether the limit lets any request through at
+// all. Zero limits are used to turn rate limiting off.
+func (l Limit) Enabled() bool {
+	return l.PerMinute > 0 && l.Burst > 0
+}
+
+// interval is how long it takes to refill one token.
+func (l Limit) interval() time.Duration {
+	return time.Minute / time.Duration(l.PerMinute)
+}
+
+// Bucket is the state of a token bucket.
+type Bucket struct {
+	Tokens float64
+	// Updated is when Tokens was last computed.
+	Updated time.Time
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until a token is available, when the
+	// request was not allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Take refills the bucket for the time elapsed since it was last
+// updated and takes a token from it if there is one. A zero Bucket
+// is full. Stores should call it to update their buckets.
+func (b *Bucket) Take(l Limit, now time.Time) Result {
+	burst := float64(l.Burst)
+	if b.Updated.IsZero() {
+		b.Tokens = burst
+	} else if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+float64(elapsed)/float64(l.interval()))
+	}
+	b.Updated = now
+
+	res := Result{Limit: l.Burst}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.Tokens) * float64(l.interval()))
+	}
+	res.Remaining = int(b.Tokens)
+	res.Reset = time.Duration((burst - b.Tokens) * float64(l.interval()))
+	return res
+}
+
+// Store keeps the buckets of a Limiter. The in-memory MemoryStore
+// is enough for a single instance, deployments running several
+// instances need a Store they all share.
+type Store interface {
+	// Take takes a token from the bucket of key, see Bucket.Take,
+	// in a single step so concurrent requests cannot both take the
+	// last token.
+	Take(key string, l Limit, now time.Time) (Result, error)
+}
+
+func New(store Store, limit Limit) *Limiter {
+	return &Limiter{
+		store: store,
+		limit: limit,
+	}
+}
+
+// Limiter limits requests by key, eg: a user ID or an IP.
+type Limiter struct {
+	store Store
+	limit Limit
+}
+
+// Take takes a token for a request made by key.
+func (l *Limiter) Take(key string) (Result, error) {
+	return l.store.Take(key, l.limit, time.Now())
+}
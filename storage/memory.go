@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemory returns a Store that keeps objects in memory. It is
+// useful for tests and for trying things out, since everything
+// is lost when the application stops.
+func NewMemory() Store {
+	return &memory{
+		objects: make(map[string]memoryObject),
+	}
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+func (m *memory) Put(key string, r io.Reader) (int64, error) {
+	if !ValidKey(key) {
+		return 0, ErrInvalidKey
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{
+		data:    data,
+		modTime: time.Now(),
+	}
+	return int64(len(data)), nil
+}
+
+func (m *memory) Get(key string) (io.ReadCloser, *Object, error) {
+	if !ValidKey(key) {
+		return nil, nil, ErrInvalidKey
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), &Object{
+		Key:     key,
+		Size:    int64(len(obj.data)),
+		ModTime: obj.modTime,
+	}, nil
+}
+
+func (m *memory) Delete(key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memory) List(prefix string) ([]Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ret []Object
+	for key, obj := range m.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		ret = append(ret, Object{
+			Key:     key,
+			Size:    int64(len(obj.data)),
+			ModTime: obj.modTime,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+	return ret, nil
+}
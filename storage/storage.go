@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when there is no object stored
+	// with the requested key.
+	ErrNotFound = errors.New("storage: object not found")
+	// ErrInvalidKey is returned when a key is empty, absolute or
+	// tries to escape the store with "..".
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// Object describes a blob stored in a Store.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Store is used to persist blobs of data, such as images, by key.
+// Keys are slash separated paths like "galleries/1/photo.jpg".
+type Store interface {
+	// Put will store the data read from r under the provided key,
+	// replacing any existing object, and return the number of
+	// bytes written.
+	Put(key string, r io.Reader) (int64, error)
+	// Get will open the object stored under the provided key. The
+	// caller must close the returned reader.
+	Get(key string) (io.ReadCloser, *Object, error)
+	// Delete will remove the object stored under the provided key.
+	// Deleting a key that does not exist is not an error.
+	Delete(key string) error
+	// List will return all objects whose key starts with prefix.
+	List(prefix string) ([]Object, error)
+}
+
+// ValidKey reports whether key is a clean, relative, slash
+// separated path that stays inside the store.
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	if path.Clean(key) != key {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeObject will write the object read from rc as the response
+// to r, and close rc when done.
+func ServeObject(w http.ResponseWriter, r *http.Request, rc io.ReadCloser, obj *Object) {
+	defer rc.Close()
+	if ct := mime.TypeByExtension(path.Ext(obj.Key)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	if !obj.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", obj.ModTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, rc)
+}
@@ -0,0 +1,75 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepEvery is how often the MemoryStore drops expired entries.
+const sweepEvery = time.Minute
+
+// NewMemoryStore returns a Store keeping the counters in memory.
+// They are lost on restart and not shared between instances.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+type memoryEntry struct {
+	Entry
+	expiresAt time.Time
+}
+
+// MemoryStore is a Store keeping the counters in a map.
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+func (s *MemoryStore) Get(key string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		return Entry{}, nil
+	}
+	return e.Entry, nil
+}
+
+func (s *MemoryStore) Incr(key string, now time.Time, ttl time.Duration) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	e, ok := s.entries[key]
+	if !ok || now.After(e.expiresAt) {
+		e = memoryEntry{}
+	}
+	e.Failures++
+	e.Last = now
+	e.expiresAt = now.Add(ttl)
+	s.entries[key] = e
+	return e.Entry, nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// sweep drops the expired entries so the map does not grow
+// forever. The lock must be held.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepEvery {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if now.After(e.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Package throttle slows down repeated failures, such as password
+// guesses, with an exponential backoff and an optional lockout.
+package throttle
+
+import (
+	"time"
+)
+
+// Entry is what a Store keeps for a key.
+type Entry struct {
+	// Failures is the number of failures recorded since the entry
+	// was created.
+	Failures int
+	// Last is when the last failure was recorded.
+	Last time.Time
+}
+
+// Store keeps the failure counters of a Limiter. The in-memory
+// MemoryStore is enough for a single instance, deployments running
+// several instances need a Store they all share.
+type Store interface {
+	// Get returns the entry of key, which is the zero Entry if no
+	// failure was recorded or the entry expired.
+	Get(key string) (Entry, error)
+	// Incr records a failure for key at now and returns the
+	// updated entry. The entry expires ttl after now.
+	Incr(key string, now time.Time, ttl time.Duration) (Entry, error)
+	// Delete forgets the failures of key.
+	Delete(key string) error
+}
+
+// Config sets how a Limiter slows down failures.
+type Config struct {
+	// Free is the number of failures allowed before we start
+	// making callers wait.
+	Free int
+	// Delay is the wait after the first failure past Free. It
+	// doubles with each failure after that, up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// LockAfter is the number of failures after which the key is
+	// locked for LockFor. Zero means keys are never locked.
+	LockAfter int
+	LockFor   time.Duration
+	// Window is how long failures are remembered for after the
+	// last one.
+	Window time.Duration
+}
+
+// wait returns how long to wait after the last of n failures.
+func (c Config) wait(n int) time.Duration {
+	if c.LockAfter > 0 && n >= c.LockAfter {
+		return c.LockFor
+	}
+	if n <= c.Free {
+		return 0
+	}
+	d := c.Delay
+	for i := c.Free + 1; i < n && d < c.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > c.MaxDelay {
+		d = c.MaxDelay
+	}
+	return d
+}
+
+// Result is the state of a key after a failure was recorded.
+type Result struct {
+	Failures int
+	// Wait is how long until the next attempt is allowed.
+	Wait time.Duration
+	// Locked is true only for the failure that locked the key,
+	// so that callers can let the owner know once.
+	Locked bool
+}
+
+func New(store Store, cfg Config) *Limiter {
+	return &Limiter{
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+// Limiter counts failures by key, eg: an email address or an IP,
+// and tells callers how long to wait before trying again.
+type Limiter struct {
+	store Store
+	cfg   Config
+}
+
+// Wait returns how long until the next attempt for key is
+// allowed, or zero if it is allowed now.
+func (l *Limiter) Wait(key string) (time.Duration, error) {
+	e, err := l.store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if e.Failures == 0 {
+		return 0, nil
+	}
+	wait := e.Last.Add(l.cfg.wait(e.Failures)).Sub(time.Now())
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// Fail records a failure for key.
+func (l *Limiter) Fail(key string) (Result, error) {
+	now := time.Now()
+	ttl := l.cfg.Window
+	if l.cfg.LockFor > ttl {
+		ttl = l.cfg.LockFor
+	}
+	if l.cfg.MaxDelay > ttl {
+		ttl = l.cfg.MaxDelay
+	}
+	e, err := l.store.Incr(key, now, ttl)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Failures: e.Failures,
+		Wait:     l.cfg.wait(e.Failures),
+		Locked:   l.cfg.LockAfter > 0 && e.Failures == l.cfg.LockAfter,
+	}, nil
+}
+
+// Reset forgets the failures of key, eg: after a successful login.
+func (l *Limiter) Reset(key string) error {
+	return l.store.Delete(key)
+}